@@ -0,0 +1,426 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * A Transport is an http.RoundTripper sending requests over SPDY:
+ *
+ *	client := &http.Client{Transport: spdy.NewTransport(nil)}
+ *
+ * https URLs are served over TLS, speaking the negotiated protocol version.
+ * http URLs are served over plain TCP, speaking the default version.
+ *
+ * Sessions are pooled by origin: concurrent requests to the same host and port share
+ * a session, until it is closed, receives GOAWAY or reaches the server's
+ * SettingsMaxConcurrentStreams. A new session is then dialed. The settings which the
+ * server asked to persist are replayed on it.
+ *
+ * Requests wait for the server to have room for their stream, until their context is
+ * done: those which the server refuses, eg. before its settings are received, are sent
+ * again once another stream closes. Their body is rewound with req.GetBody, if any.
+ */
+type Transport struct {
+	TLSClientConfig	*tls.Config	// TLS configuration for https URLs. The default configuration if nil
+	// Called with each resource pushed by servers. It must close resp.Body.
+	// If nil, pushed resources are refused. See Session.PushHandler.
+	PushHandler	func(req *http.Request, resp *http.Response)
+	// Limits on the frames received from servers, as in Framer. The defaults apply if they are 0.
+	MaxHeaders	int
+	MaxHeaderBytes	int
+	MaxFramePayload	int
+	// Compression of the header blocks exchanged with servers. zlib.BestCompression if nil.
+	HeaderCompression	*HeaderCompression
+	// Time allowed to connect to a server, TLS handshake included. DefaultDialTimeout if 0.
+	DialTimeout	time.Duration
+	pool		sessionPool
+}
+
+// Time allowed by a Transport to connect to a server, unless Transport.DialTimeout is set.
+const DefaultDialTimeout = 30 * time.Second
+
+func NewTransport(config *tls.Config) *Transport {
+	return &Transport{TLSClientConfig: config}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scheme := req.URL.Scheme
+	var addr string
+	switch scheme {
+		case "https":	addr = hostPort(req.URL.Host, "443")
+		case "http":	addr = hostPort(req.URL.Host, "80")
+		default: {
+			closeBody(req)
+			return nil, errors.New(fmt.Sprintf("Unsupported protocol scheme: '%s'", scheme))
+		}
+	}
+	body := req.Body
+	for {
+		session, err := t.pool.get(req.Context(), scheme + "://" + addr, func(ctx context.Context) (*Session, error) { return t.dial(ctx, scheme, addr) })
+		if err != nil {
+			closeReader(body)
+			return nil, err
+		}
+		resp, err := session.roundTrip(req, body)
+		if err == nil {
+			return resp, nil
+		}
+		if !isRetryable(err, req) {
+			closeReader(body)
+			return nil, err
+		}
+		/* The request was not processed: send it again */
+		if e := err.(*Error); e.Err == StreamNotProcessed {
+			if err := session.waitForRoom(req.Context(), e); err != nil {
+				closeReader(body)
+				return nil, err
+			}
+			/* The body was handed to the stream, and may be partly sent */
+			if body != nil {
+				if body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		debug("Retrying request: %s", err)
+	}
+}
+
+/* Close the sessions which have no open streams */
+func (t *Transport) CloseIdleConnections() {
+	t.pool.closeIdle()
+}
+
+/* Connect to `addr` and return a new client session, within t.DialTimeout */
+func (t *Transport) dial(ctx context.Context, scheme, addr string) (*Session, error) {
+	timeout := t.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var config *tls.Config
+	if scheme == "https" {
+		config = t.TLSClientConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+	}
+	return dialContext(ctx, addr, config, nil, t.setupSession)
+}
+
+/* Apply the transport's settings to a new session and its framer */
+func (t *Transport) setupSession(session *Session, framer *Framer) error {
+	session.PushHandler = t.PushHandler
+	/* Requests wait for the server to have room for their stream: see RoundTrip */
+	session.WaitForStreams = true
+	framer.MaxHeaders = t.MaxHeaders
+	framer.MaxHeaderBytes = t.MaxHeaderBytes
+	framer.MaxFramePayload = t.MaxFramePayload
+	return t.HeaderCompression.apply(framer)
+}
+
+/* Return true if `req` can be sent again after failing with `err` */
+func isRetryable(err error, req *http.Request) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	switch e.Err {
+		case TooManyStreams, SessionGoingAway:	return true
+		case StreamNotProcessed:		return req.Body == nil || req.GetBody != nil
+	}
+	return false
+}
+
+func closeBody(req *http.Request) {
+	closeReader(req.Body)
+}
+
+func closeReader(body io.ReadCloser) {
+	if body != nil {
+		body.Close()
+	}
+}
+
+/*
+ * After the peer refused `refused` (a StreamNotProcessed error) on `session`, wait until
+ * another local stream closes, so that the peer has room for a new stream, unless `ctx`
+ * is done first. If the session can't initiate streams anymore, return right away: the
+ * stream can be sent on another session.
+ *
+ * If no other stream is open, return right away too if the refused stream was initiated
+ * before the peer's SettingsMaxConcurrentStreams was received: from now on, InitiateStream
+ * respects it. Otherwise, the peer didn't refuse the stream for lack of room: `refused`
+ * is returned.
+ */
+func (session *Session) waitForRoom(ctx context.Context, refused *Error) error {
+	/* Wake up the wait if ctx expires */
+	stop := context.AfterFunc(ctx, func() {
+		session.lock.Lock()
+		session.streamsChanged.Broadcast()
+		session.lock.Unlock()
+	})
+	defer stop()
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	open := -1
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if session.closed || session.goingAway || session.peerGoingAway {
+			return nil
+		}
+		/* Don't count the refused stream, if it isn't de-registered yet */
+		if _, exists := session.streams[refused.StreamId]; !exists {
+			if open == -1 {
+				open = session.nStreamsOut()
+				if open == 0 {
+					if session.peerLimitKnown && refused.StreamId <= session.lastIdBeforeLimit {
+						return nil
+					}
+					return refused
+				}
+			} else if session.nStreamsOut() < open {
+				return nil
+			}
+		}
+		session.streamsChanged.Wait()
+	}
+}
+
+/* Add `port` to `host` unless it already has one */
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+/*
+ * Send `req` on a new stream, and return the response once its headers are received.
+ * The response body streams the DATA frames of the reply.
+ */
+func (session *Session) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := session.roundTrip(req, req.Body)
+	if err != nil {
+		closeBody(req)
+	}
+	return resp, err
+}
+
+/*
+ * Like RoundTrip, but send `body` instead of req.Body, and leave it open if the stream
+ * could not be opened. Once it is, `body` is closed after it is sent.
+ * If the request's context is cancelled, the stream is reset.
+ */
+func (session *Session) roundTrip(req *http.Request, body io.ReadCloser) (*http.Response, error) {
+	stream, err := session.openStream(req.Context(), requestHeaders(req, session.Version), body == nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		go func() {
+			defer body.Close()
+			if err := stream.CopyFrom(body); err != nil {
+				stream.debug("Error while sending request body: %s", err)
+				stream.Rst(Cancel)
+				return
+			}
+			stream.WriteDataFrame(nil, true)
+		}()
+	}
+	return stream.readResponse(req)
+}
+
+/* Return the SYN_STREAM headers of `req` */
+func requestHeaders(req *http.Request, version uint16) *http.Header {
+	headers := make(http.Header)
+	for name, values := range req.Header {
+		if invalidReqHeaders[name] || name == "Host" {
+			continue
+		}
+		headers[name] = values
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	/* Version 3 prefixes special headers with ':' */
+	prefix := ""
+	if version >= Version3 {
+		prefix = ":"
+	}
+	headers.Set(prefix + "method", method)
+	headers.Set(prefix + "scheme", scheme)
+	headers.Set(prefix + "version", "HTTP/1.1")
+	headers.Set(prefix + "host", host)
+	if version >= Version3 {
+		headers.Set(":path", req.URL.RequestURI())
+	} else {
+		headers.Set("url", req.URL.RequestURI())
+	}
+	return &headers
+}
+
+/* Wait for the reply to a request sent on `s`, and return it as a response to `req` */
+func (s *Stream) readResponse(req *http.Request) (*http.Response, error) {
+	var headers *http.Header
+	for headers == nil {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch f := frame.(type) {
+			case *SynReplyFrame:	headers = &f.Headers
+			case *RstStreamFrame: {
+				if f.Status == RefusedStream {
+					/* The server guarantees that it did not process the request */
+					return nil, &Error{StreamNotProcessed, s.Id}
+				}
+				return nil, errors.New(fmt.Sprintf("Stream %d was reset (status %d)", s.Id, f.Status))
+			}
+		}
+	}
+	return s.newResponse(req, headers)
+}
+
+/* Return a response to `req` with `headers`, streaming the DATA frames of `s` */
+func (s *Stream) newResponse(req *http.Request, headers *http.Header) (*http.Response, error) {
+	/* Version 3 prefixes special headers with ':' */
+	status, proto := headers.Get("status"), headers.Get("version")
+	if s.version >= Version3 {
+		status, proto = headers.Get(":status"), headers.Get(":version")
+	}
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil {
+		s.Rst(ProtocolError)
+		return nil, errors.New(fmt.Sprintf("Invalid status in reply: '%s'", status))
+	}
+	if !strings.Contains(status, " ") {
+		status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+	}
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		major, minor = 1, 1
+	}
+	resp := &http.Response{
+		Status:		status,
+		StatusCode:	code,
+		Proto:		proto,
+		ProtoMajor:	major,
+		ProtoMinor:	minor,
+		Header:		make(http.Header),
+		ContentLength:	-1,
+		Request:	req,
+	}
+	for name, values := range *headers {
+		switch name {
+			case "Status", "Version", "Url", ":status", ":version", ":scheme", ":host", ":path":
+			default:	resp.Header[name] = values
+		}
+	}
+	if length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = length
+	}
+	bodyReader, bodyWriter := io.Pipe()
+	go func() {
+		bodyWriter.CloseWithError(ExtractData(s, bodyWriter))
+	}()
+	resp.Body = &streamBody{PipeReader: bodyReader, stream: s}
+	return resp, nil
+}
+
+/* A response body which resets the stream if it is closed before the end */
+type streamBody struct {
+	*io.PipeReader
+	stream	*Stream
+}
+
+func (body *streamBody) Close() error {
+	/* This fails harmlessly if the stream is already closed */
+	body.stream.Rst(Cancel)
+	return body.PipeReader.Close()
+}
+
+/* Set session.PushHandler, which is safe even once the session is served */
+func (session *Session) SetPushHandler(handler func(req *http.Request, resp *http.Response)) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.PushHandler = handler
+}
+
+/*
+ * Receive a resource pushed by the server on `s`, and pass it to `handler`.
+ * Without a handler, the stream is cancelled.
+ */
+func (s *Stream) servePush(handler func(req *http.Request, resp *http.Response)) {
+	if handler == nil {
+		s.Rst(Cancel)
+		return
+	}
+	frame, err := s.ReadFrame()
+	if err != nil {
+		return
+	}
+	headers := make(http.Header)
+	UpdateHeaders(&headers, frame.GetHeaders())
+	/* Version 3 splits the url */
+	url := headers.Get("url")
+	if s.version >= Version3 {
+		url = headers.Get(":scheme") + "://" + headers.Get(":host") + headers.Get(":path")
+	}
+	req, err := http.NewRequestWithContext(s.Context(), "GET", url, nil)
+	if err != nil {
+		s.debug("Invalid url in pushed stream: %s", err)
+		s.Rst(ProtocolError)
+		return
+	}
+	/* The response status may come in a HEADERS frame */
+	status := "status"
+	if s.version >= Version3 {
+		status = ":status"
+	}
+	for headers.Get(status) == "" {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return
+		}
+		if _, isRst := frame.(*RstStreamFrame); isRst {
+			return
+		}
+		if _, isHeaders := frame.(*HeadersFrame); !isHeaders {
+			s.debug("Received %#v before the status of a pushed stream", frame)
+			s.Rst(ProtocolError)
+			return
+		}
+		UpdateHeaders(&headers, frame.GetHeaders())
+	}
+	resp, err := s.newResponse(req, &headers)
+	if err != nil {
+		return
+	}
+	handler(req, resp)
+}
@@ -0,0 +1,301 @@
+package spdy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/* Maximum number of remote streams waiting for Accept. Excess streams are refused. */
+const acceptBacklog = 64
+
+/* Size of the DATA frames sent by Conn.Write */
+const connFrameSize = 4096
+
+/*
+ * A Conn is a stream used as a net.Conn, to tunnel arbitrary protocols over a session:
+ * written bytes are sent in DATA frames, and CloseWrite half-closes the stream with FIN.
+ *
+ * Conns are returned by Session.Open and Session.Accept.
+ */
+type Conn struct {
+	stream		*Stream
+	session		*Session
+	data		chan []byte	// DATA received by the receive goroutine. Closed after readErr is set
+	pending		[]byte		// Data received but not read yet
+	readErr		error
+	readLock	sync.Mutex
+	writeLock	sync.Mutex
+	readDeadline	*deadline	// The write deadline is the stream's
+	lock		sync.Mutex	// Protects the fields below
+	finReceived	bool
+	closed		bool
+	done		chan bool	// Closed by Close
+}
+
+/*
+ * Open a new stream with a SYN_STREAM carrying `headers`, and return it as a Conn.
+ * It doesn't wait for the peer to reply: data can be written right away.
+ */
+func (session *Session) Open(headers http.Header) (*Conn, error) {
+	stream, err := session.OpenStream(context.Background(), &headers)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(session, stream), nil
+}
+
+/*
+ * Wait for the peer to open a stream, and return it as a Conn, with the headers of its
+ * SYN_STREAM. The stream is replied to right away.
+ *
+ * Only sessions without a handler accept streams. Streams opened by the peer before the
+ * first call to Accept are refused, unless session.AcceptStreams is set. Up to
+ * acceptBacklog streams wait for Accept, after which new streams are refused. Once the
+ * session is closed, Accept fails with io.EOF.
+ */
+func (session *Session) Accept() (*Conn, http.Header, error) {
+	accepted := session.acceptQueue(true)
+	for {
+		select {
+			case stream := <-accepted: {
+				frame, err := stream.ReadFrame()
+				if err != nil {
+					/* The stream was reset before we got to it */
+					continue
+				}
+				headers := make(http.Header)
+				UpdateHeaders(&headers, frame.GetHeaders())
+				if !stream.unidirectional {
+					if err := stream.Reply(nil, false); err != nil {
+						continue
+					}
+				}
+				conn := newConn(session, stream)
+				if frame.GetFinFlag() {
+					conn.finish(io.EOF)
+				} else {
+					go conn.receive()
+				}
+				return conn, headers, nil
+			}
+			case <-session.ctx.Done():
+				return nil, nil, io.EOF
+		}
+	}
+}
+
+/*
+ * Queue a new remote stream for Accept. Return false if streams are not accepted, or
+ * too many are waiting: the caller must refuse it.
+ */
+func (session *Session) backlog(stream *Stream) bool {
+	accepted := session.acceptQueue(false)
+	if accepted == nil {
+		return false
+	}
+	select {
+		case accepted <- stream:	return true
+		default:			return false
+	}
+}
+
+/*
+ * Return the queue of streams waiting for Accept. It is created if `create` is true, or
+ * session.AcceptStreams is set. Until then, it is nil.
+ */
+func (session *Session) acceptQueue(create bool) chan *Stream {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.accepted == nil && (create || session.AcceptStreams) {
+		session.accepted = make(chan *Stream, acceptBacklog)
+	}
+	return session.accepted
+}
+
+func newConn(session *Session, stream *Stream) *Conn {
+	conn := &Conn{
+		stream:		stream,
+		session:	session,
+		data:		make(chan []byte),
+		readDeadline:	newDeadline(nil),
+		done:		make(chan bool),
+	}
+	if stream.local {
+		go conn.receive()
+	}
+	return conn
+}
+
+/* Pass the DATA received on the stream to Read, until FIN or an error */
+func (c *Conn) receive() {
+	for {
+		frame, err := c.stream.ReadFrame()
+		if err != nil {
+			c.finish(err)
+			return
+		}
+		switch f := frame.(type) {
+			case *RstStreamFrame: {
+				c.finish(&Error{StreamReset, c.stream.Id})
+				return
+			}
+			case *DataFrame: {
+				if len(f.Data) > 0 {
+					select {
+						case c.data <- f.Data:
+						case <-c.done:	return
+					}
+				}
+			}
+		}
+		if frame.GetFinFlag() {
+			c.finish(io.EOF)
+			return
+		}
+	}
+}
+
+/* Make Read fail with `err` once all the data received is read */
+func (c *Conn) finish(err error) {
+	c.lock.Lock()
+	c.finReceived = err == io.EOF
+	c.lock.Unlock()
+	c.readErr = err
+	close(c.data)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if len(c.pending) == 0 {
+		select {
+			case data, ok := <-c.data: {
+				if !ok {
+					return 0, c.readErr
+				}
+				c.pending = data
+			}
+			case <-c.readDeadline.wait():	return 0, os.ErrDeadlineExceeded
+			case <-c.done:			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+/*
+ * Send `b` in DATA frames, blocking until the flow control windows allow it, and return
+ * the number of bytes sent. If the write deadline passes first, the data may have been
+ * partially sent: the stream is reset with Cancel, and Write fails with os.ErrDeadlineExceeded.
+ */
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	/* The frames are queued until they are sent: don't keep a reference to `b` */
+	data := append([]byte(nil), b...)
+	for sent := 0; sent < len(data); {
+		n := len(data) - sent
+		if n > connFrameSize {
+			n = connFrameSize
+		}
+		if err := c.stream.WriteDataFrame(data[sent:sent + n], false); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return len(b), nil
+}
+
+/* Half-close the stream: send FIN. Data can still be read until the peer sends FIN. */
+func (c *Conn) CloseWrite() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.stream.WriteDataFrame(nil, true)
+}
+
+/*
+ * Close the stream. If the peer hasn't sent FIN yet, the stream is reset with Cancel.
+ * Otherwise, FIN is sent, unless it already was.
+ */
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	finReceived := c.finReceived
+	c.lock.Unlock()
+	close(c.done)
+	if !finReceived {
+		c.stream.Rst(Cancel)
+	} else {
+		c.stream.WriteDataFrame(nil, true)
+	}
+	return nil
+}
+
+func (c *Conn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+/* Return the local address of the session's connection, if any */
+func (c *Conn) LocalAddr() net.Addr {
+	if conn, ok := c.session.transport.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return streamAddr(c.stream.Id)
+}
+
+/* Return the remote address of the session's connection, if any */
+func (c *Conn) RemoteAddr() net.Addr {
+	if conn, ok := c.session.transport.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return streamAddr(c.stream.Id)
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return c.stream.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+/* Return the stream underlying the Conn */
+func (c *Conn) Stream() *Stream {
+	return c.stream
+}
+
+/* The address of a stream, on a session which is not served over a network connection */
+type streamAddr uint32
+
+func (a streamAddr) Network() string {
+	return "spdy"
+}
+
+func (a streamAddr) String() string {
+	return fmt.Sprintf("stream %d", uint32(a))
+}
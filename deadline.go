@@ -0,0 +1,78 @@
+package spdy
+
+import (
+	"sync"
+	"time"
+)
+
+/* A deadline is a channel which is closed when the deadline passes, for use in select */
+type deadline struct {
+	lock		sync.Mutex
+	timer		*time.Timer
+	expired		chan bool
+	onExpire	func()	// Called, if set, when the deadline passes
+}
+
+func newDeadline(onExpire func()) *deadline {
+	return &deadline{expired: make(chan bool), onExpire: onExpire}
+}
+
+/* Set the deadline to `t`. The zero time means no deadline. */
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	if d.timer != nil && !d.timer.Stop() {
+		/* The timer fired: wait for it to close the channel */
+		<-d.expired
+	}
+	d.timer = nil
+	closed := false
+	select {
+		case <-d.expired:	closed = true
+		default:
+	}
+	if !t.IsZero() && time.Until(t) <= 0 {
+		if !closed {
+			close(d.expired)
+		}
+		d.lock.Unlock()
+		if !closed {
+			d.expire()
+		}
+		return
+	}
+	if closed {
+		d.expired = make(chan bool)
+	}
+	if !t.IsZero() {
+		expired := d.expired
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			close(expired)
+			d.expire()
+		})
+	}
+	d.lock.Unlock()
+}
+
+func (d *deadline) expire() {
+	if d.onExpire != nil {
+		d.onExpire()
+	}
+}
+
+/* Return a channel which is closed once the deadline passes. A nil deadline never passes. */
+func (d *deadline) wait() chan bool {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.expired
+}
+
+/* Return true if the deadline has passed */
+func (d *deadline) passed() bool {
+	select {
+		case <-d.wait():	return true
+		default:		return false
+	}
+}
@@ -0,0 +1,145 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ExtensionPayload is the payload of a control frame type defined by the
+// application. Register the type with RegisterControlFrame.
+type ExtensionPayload interface {
+	// ReadPayload decodes the payload of a frame received over a given protocol version.
+	ReadPayload(version uint16, payload []byte) error
+	// WritePayload encodes the payload of a frame sent over a given protocol version.
+	WritePayload(version uint16) ([]byte, error)
+}
+
+// ExtensionFrame is a control frame of a type registered with RegisterControlFrame.
+// Sessions pass the ones they receive to their ExtensionHandler.
+type ExtensionFrame struct {
+	CFHeader ControlFrameHeader
+	Payload  ExtensionPayload
+}
+
+var (
+	extensionLock  sync.RWMutex
+	extensionCtors = map[ControlFrameType]func() ExtensionPayload{}
+)
+
+// RegisterControlFrame makes Framers parse control frames of type frameType as
+// an ExtensionFrame, with a payload allocated by newPayload. Frames of types which
+// are not registered are read as an UnknownFrame.
+//
+// The types defined by the protocol can't be registered, nor can a type be
+// registered twice.
+func RegisterControlFrame(frameType ControlFrameType, newPayload func() ExtensionPayload) error {
+	if _, builtin := cframeCtor[frameType]; builtin {
+		return fmt.Errorf("spdy: control frame type %d is defined by the protocol", frameType)
+	}
+	if newPayload == nil {
+		return errors.New("spdy: nil payload constructor")
+	}
+	extensionLock.Lock()
+	defer extensionLock.Unlock()
+	if _, exists := extensionCtors[frameType]; exists {
+		return fmt.Errorf("spdy: control frame type %d is already registered", frameType)
+	}
+	extensionCtors[frameType] = newPayload
+	return nil
+}
+
+// newExtensionFrame returns an empty ExtensionFrame of a registered type, or nil.
+func newExtensionFrame(frameType ControlFrameType) controlFrame {
+	extensionLock.RLock()
+	newPayload, exists := extensionCtors[frameType]
+	extensionLock.RUnlock()
+	if !exists {
+		return nil
+	}
+	return &ExtensionFrame{Payload: newPayload()}
+}
+
+// NewExtensionFrame returns a frame of a registered type, ready to be sent.
+func NewExtensionFrame(frameType ControlFrameType, flags ControlFlags, payload ExtensionPayload) *ExtensionFrame {
+	return &ExtensionFrame{
+		CFHeader: ControlFrameHeader{frameType: frameType, Flags: flags},
+		Payload:  payload,
+	}
+}
+
+// Type returns the type of the control frame.
+func (frame *ExtensionFrame) Type() ControlFrameType {
+	return frame.CFHeader.frameType
+}
+
+func (frame *ExtensionFrame) read(h ControlFrameHeader, f *Framer) error {
+	frame.CFHeader = h
+	/* Read the whole payload first, so that the Framer stays in sync even if it is invalid */
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		return err
+	}
+	if err := frame.Payload.ReadPayload(f.version, payload); err != nil {
+		return &invalidExtension{&UnknownFrame{CFHeader: h, Payload: payload, Err: err}}
+	}
+	return nil
+}
+
+// invalidExtension is returned by ExtensionFrame.read when the payload can't be decoded.
+// Extensions are optional, so parseControlFrame returns the frame as an UnknownFrame
+// instead of failing.
+type invalidExtension struct {
+	frame *UnknownFrame
+}
+
+func (e *invalidExtension) Error() string {
+	return fmt.Sprintf("spdy: invalid payload of control frame type %d: %s", e.frame.Type(), e.frame.Err)
+}
+
+func (frame *ExtensionFrame) write(f *Framer) error {
+	payload, err := frame.Payload.WritePayload(f.version)
+	if err != nil {
+		return err
+	}
+	if len(payload) > int(f.maxFramePayload()) {
+		return &Error{PayloadTooLarge, 0}
+	}
+	frame.CFHeader.version = f.version
+	frame.CFHeader.length = uint32(len(payload))
+	if err := writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
+		return err
+	}
+	_, err = f.w.Write(payload)
+	return err
+}
+
+func (frame *ExtensionFrame) GetStreamId() (uint32, bool)	{ return 0, false }
+func (frame *ExtensionFrame) GetHeaders() *http.Header		{ return nil }
+func (frame *ExtensionFrame) GetFinFlag() bool			{ return false }
+
+/* Send an extension frame to the peer. It jumps the queue like other control frames. */
+func (session *Session) SendExtensionFrame(frame *ExtensionFrame) error {
+	return session.output.WriteFrame(frame)
+}
+
+/* Set session.ExtensionHandler, which is safe even once the session is served */
+func (session *Session) SetExtensionHandler(handler func(frame *ExtensionFrame)) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.ExtensionHandler = handler
+}
+
+/* Pass an extension frame received from the peer to session.ExtensionHandler, if any */
+func (session *Session) receiveExtension(frame *ExtensionFrame) {
+	session.lock.Lock()
+	handler := session.ExtensionHandler
+	session.lock.Unlock()
+	if handler == nil {
+		debug("Ignoring extension frame of type %d", frame.Type())
+		return
+	}
+	handler(frame)
+}
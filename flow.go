@@ -0,0 +1,225 @@
+package spdy
+
+import (
+	"sync"
+)
+
+// DefaultInitialWindowSize is the initial flow control window of a stream,
+// in bytes, when the peer hasn't specified otherwise. It is also the initial
+// size of the session-wide window. Flow control was introduced in version 3,
+// and session-wide flow control in version 3.1.
+const DefaultInitialWindowSize = 64 * 1024
+
+// MaxWindowSize is the largest flow control window allowed by the spec.
+const MaxWindowSize = 1<<31 - 1
+
+/*
+ * A sendWindow tracks how many bytes of DATA we are allowed to send to the peer.
+ * Writers block in take() until the window is open.
+ */
+type sendWindow struct {
+	lock	sync.Mutex
+	cond	*sync.Cond
+	size	int64
+	closed	bool
+}
+
+func newSendWindow(size int32) *sendWindow {
+	w := &sendWindow{size: int64(size)}
+	w.cond = sync.NewCond(&w.lock)
+	return w
+}
+
+/*
+ * Wait until the window is open, then reserve up to `n` bytes of it.
+ * Return the number of bytes reserved, or an error if the window was closed.
+ *
+ * If `owner` is not nil, also give up waiting when `owner` is closed. This allows
+ * streams waiting on the session window to be cancelled.
+ */
+func (w *sendWindow) take(n int, owner *sendWindow) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for w.size <= 0 && !w.closed && n > 0 && !owner.isClosed() {
+		w.cond.Wait()
+	}
+	if w.closed || owner.isClosed() {
+		return 0, &Error{Err: StreamClosed}
+	}
+	if int64(n) > w.size {
+		n = int(w.size)
+	}
+	if n < 0 {
+		n = 0
+	}
+	w.size -= int64(n)
+	return n, nil
+}
+
+/*
+ * Grow the window by `delta` bytes (or shrink it if `delta` is negative).
+ * Return false if the window would exceed MaxWindowSize, in which case it is left untouched.
+ */
+func (w *sendWindow) add(delta int64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.size + delta > MaxWindowSize {
+		return false
+	}
+	w.size += delta
+	w.cond.Broadcast()
+	return true
+}
+
+/* Wake up all blocked writers, and make future calls to take() fail */
+func (w *sendWindow) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+/* Wake up all blocked writers, so they can check whether they were cancelled */
+func (w *sendWindow) wake() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.cond.Broadcast()
+}
+
+func (w *sendWindow) isClosed() bool {
+	if w == nil {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closed
+}
+
+/*
+ * A recvWindow tracks how many bytes of DATA the peer is allowed to send us,
+ * and sends WINDOW_UPDATE frames as the application consumes data.
+ *
+ * Stream windows have the session window as parent: data consumed on a stream
+ * is also consumed on the session.
+ */
+type recvWindow struct {
+	lock		sync.Mutex
+	id		uint32	// Stream the window applies to, or 0 for the session
+	size		int32	// Initial window size
+	available	int64	// How many bytes the peer may still send
+	pending		int64	// How many bytes were received, but not consumed yet
+	consumed	int64	// How many bytes were consumed without sending a WINDOW_UPDATE
+	finished	bool	// Set when the peer is done sending: no more WINDOW_UPDATEs
+	closed		bool	// Set when the stream is closed: pending bytes were given back to the parent
+	updates		Writer	// Where to send WINDOW_UPDATE frames
+	parent		*recvWindow
+}
+
+func newRecvWindow(id uint32, size int32, updates Writer, parent *recvWindow) *recvWindow {
+	return &recvWindow{id: id, size: size, available: int64(size), updates: updates, parent: parent}
+}
+
+/*
+ * Account for `n` bytes received from the peer. Return false if the peer overran the window.
+ * If the stream is already closed, nobody will consume them: they go back to the parent window.
+ */
+func (w *recvWindow) receive(n int) bool {
+	w.lock.Lock()
+	if int64(n) > w.available {
+		w.lock.Unlock()
+		return false
+	}
+	w.available -= int64(n)
+	if !w.closed {
+		w.pending += int64(n)
+		w.lock.Unlock()
+		return true
+	}
+	w.lock.Unlock()
+	if w.parent != nil {
+		w.parent.consume(n)
+	}
+	return true
+}
+
+/*
+ * Account for `n` bytes consumed by the application.
+ * Once at least half of the window is consumed, tell the peer to send more.
+ */
+func (w *recvWindow) consume(n int) error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return nil
+	}
+	w.pending -= int64(n)
+	w.consumed += int64(n)
+	var update *WindowUpdateFrame
+	if !w.finished && w.consumed >= int64(w.size / 2) {
+		update = &WindowUpdateFrame{StreamId: w.id, DeltaWindowSize: uint32(w.consumed)}
+		w.available += w.consumed
+		w.consumed = 0
+	}
+	w.lock.Unlock()
+	if w.parent != nil {
+		if err := w.parent.consume(n); err != nil {
+			return err
+		}
+	}
+	if update != nil {
+		return w.updates.WriteFrame(update)
+	}
+	return nil
+}
+
+/* Grow the window to `size` bytes, and tell the peer about it */
+func (w *recvWindow) grow(size int32) error {
+	w.lock.Lock()
+	delta := int64(size) - int64(w.size)
+	if delta <= 0 {
+		w.lock.Unlock()
+		return nil
+	}
+	w.size = size
+	w.available += delta
+	w.lock.Unlock()
+	return w.updates.WriteFrame(&WindowUpdateFrame{StreamId: w.id, DeltaWindowSize: uint32(delta)})
+}
+
+/*
+ * Change the initial window size to `size`, without telling the peer: the new size was
+ * advertised with SETTINGS. The window is adjusted by the difference.
+ */
+func (w *recvWindow) resize(size int32) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.available += int64(size) - int64(w.size)
+	w.size = size
+}
+
+/* Stop sending WINDOW_UPDATE frames, because the peer is done sending */
+func (w *recvWindow) finish() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.finished = true
+}
+
+/*
+ * Stop accounting for consumed data, because the stream is closed.
+ * Data which was received but not consumed is given back to the parent window.
+ */
+func (w *recvWindow) close() {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return
+	}
+	w.closed = true
+	w.finished = true
+	pending := w.pending
+	w.pending = 0
+	w.lock.Unlock()
+	if w.parent != nil && pending > 0 {
+		w.parent.consume(int(pending))
+	}
+}
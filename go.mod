@@ -0,0 +1,3 @@
+module github.com/shykes/spdy-go
+
+go 1.21
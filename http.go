@@ -2,14 +2,19 @@ package spdy
 
 import (
 	"net/http"
+	"net/url"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 )
 
 type ResponseWriter struct {
 	*Stream
 	headers	*http.Header
 	sentHeaders bool
+	request	*http.Request	// Request being served, for pushes
+	handler	http.Handler
 }
 
 func (w *ResponseWriter) Header() http.Header {
@@ -25,7 +30,8 @@ func (w *ResponseWriter) Write(data []byte) (int, error) {
 		w.WriteHeader(http.StatusOK)
 	}
 	debug("Sending %v\n", data)
-	err := w.WriteDataFrame(data, false)
+	/* The frame is queued until it is sent, and callers may reuse `data` */
+	err := w.WriteDataFrame(append([]byte(nil), data...), false)
 	if err != nil {
 		debug("error: %s", err)
 		return 0, err
@@ -37,10 +43,15 @@ func (w *ResponseWriter) Write(data []byte) (int, error) {
 func (w *ResponseWriter) WriteHeader(status int) {
 	fin := status == 0 // Status=0 will half-close the stream 
 	debug("WriteHeader() header = %v\n", w.Header())
-	if w.output.Headers.Get("status") == "" {
+	if w.version >= Version3 {
+		if w.output.Headers.Get(":status") == "" {
+			w.Header().Set(":status", fmt.Sprintf("%d %s", status, http.StatusText(status)))
+			w.Header().Set(":version", "HTTP/1.1")
+		}
+	} else if w.output.Headers.Get("status") == "" {
 		w.Header().Set("status", fmt.Sprintf("%d", status))
 	}
-	if w.output.NFrames == 0 {
+	if w.output.nFrames() == 0 {
 		if w.local {
 			w.Syn(w.headers, fin)
 		} else {
@@ -55,3 +66,77 @@ func (w *ResponseWriter) WriteHeader(status int) {
 	}
 	w.sentHeaders = true
 }
+
+/*
+ * Push the resource at `target` (an absolute path or URL) to the client, on a
+ * unidirectional stream associated with the request. The resource is served by the
+ * same handler, with a synthetic request. Implements http.Pusher.
+ */
+func (w *ResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if w.session == nil || w.local || w.request == nil {
+		return http.ErrNotSupported
+	}
+	if opts == nil {
+		opts = &http.PushOptions{}
+	}
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	if method != "GET" && method != "HEAD" {
+		return errors.New(fmt.Sprintf("Can't push a %s request", method))
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		if !strings.HasPrefix(target, "/") {
+			return errors.New(fmt.Sprintf("Can't push a relative path: '%s'", target))
+		}
+		u.Scheme, u.Host = requestScheme(w.request, w.version), w.request.Host
+	}
+	/* Version 3 splits the url, and moves the response status to a HEADERS frame */
+	headers := make(http.Header)
+	if w.version >= Version3 {
+		headers.Set(":scheme", u.Scheme)
+		headers.Set(":host", u.Host)
+		headers.Set(":path", u.RequestURI())
+	} else {
+		headers.Set("url", u.String())
+	}
+	stream, err := w.session.initiatePush(w.Id, &headers)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(stream.Context(), method, u.String(), nil)
+	if err != nil {
+		stream.Rst(InternalError)
+		return err
+	}
+	for name, values := range opts.Header {
+		r.Header[name] = values
+	}
+	r.RemoteAddr = w.request.RemoteAddr
+	go stream.servePushed(w.handler, r)
+	return nil
+}
+
+/* Serve a pushed resource on `s` */
+func (s *Stream) servePushed(handler http.Handler, r *http.Request) {
+	w := &ResponseWriter{Stream: s, request: r, handler: handler}
+	handler.ServeHTTP(w, r)
+	s.WriteDataFrame(nil, true) // Close the stream in case the handler hasn't
+}
+
+/* Return the scheme of a request received over SPDY, "https" if unknown */
+func requestScheme(r *http.Request, version uint16) string {
+	scheme := r.Header.Get("scheme")
+	if version >= Version3 {
+		scheme = r.Header.Get(":scheme")
+	}
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme
+}
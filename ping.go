@@ -0,0 +1,110 @@
+package spdy
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+/*
+ * Send a PING to the peer and wait for its reply, to measure the round-trip time.
+ * Clients send odd ids and servers even ids, so that replies to our own pings can
+ * be told apart from the pings initiated by the peer.
+ *
+ * If `ctx` expires first, ctx.Err() is returned. If the session is closed, io.EOF.
+ */
+func (session *Session) Ping(ctx context.Context) (time.Duration, error) {
+	reply := make(chan bool)
+	session.pingLock.Lock()
+	id := session.nextPingId()
+	session.pings[id] = reply
+	session.pingLock.Unlock()
+	defer func() {
+		session.pingLock.Lock()
+		delete(session.pings, id)
+		session.pingLock.Unlock()
+	}()
+	start := time.Now()
+	if err := session.output.writeFrame(ctx, &PingFrame{Id: id}); err != nil {
+		return 0, err
+	}
+	select {
+		case <-reply:			return time.Since(start), nil
+		case <-ctx.Done():		return 0, ctx.Err()
+		case <-session.ctx.Done():	return 0, io.EOF
+	}
+}
+
+/* Allocate the id of a new PING. Ids wrap around, skipping 0. The caller must hold session.pingLock. */
+func (session *Session) nextPingId() uint32 {
+	if session.lastPingId == 0 {
+		if session.Server {
+			session.lastPingId = 2
+		} else {
+			session.lastPingId = 1
+		}
+		return session.lastPingId
+	}
+	session.lastPingId += 2
+	if session.lastPingId == 0 {
+		session.lastPingId = 2
+	}
+	return session.lastPingId
+}
+
+/* Echo the pings initiated by the peer, and wake up Ping when the peer replies to ours */
+func (session *Session) receivePing(frame *PingFrame) error {
+	if !session.isLocalId(frame.Id) {
+		return session.output.WriteFrame(frame)
+	}
+	session.pingLock.Lock()
+	defer session.pingLock.Unlock()
+	if reply, exists := session.pings[frame.Id]; exists {
+		close(reply)
+		delete(session.pings, frame.Id)
+	} else {
+		debug("Ignoring reply to unknown ping %d", frame.Id)
+	}
+	return nil
+}
+
+/*
+ * Ping the peer whenever nothing was received for session.KeepAliveInterval, and close
+ * the session and its transport if the peer doesn't reply within session.KeepAliveTimeout.
+ */
+func (session *Session) keepAlive() {
+	timeout := session.KeepAliveTimeout
+	if timeout == 0 {
+		timeout = session.KeepAliveInterval
+	}
+	started := time.Now()
+	timer := time.NewTimer(session.KeepAliveInterval)
+	defer timer.Stop()
+	for {
+		select {
+			case <-timer.C:
+			case <-session.ctx.Done():	return
+		}
+		last := started
+		if received := session.lastReceived.Load(); received != 0 {
+			last = time.Unix(0, received)
+		}
+		idle := time.Since(last)
+		if idle < session.KeepAliveInterval {
+			timer.Reset(session.KeepAliveInterval - idle)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(session.ctx, timeout)
+		_, err := session.Ping(ctx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			debug("No reply to keepalive ping after %s: closing the session", timeout)
+			session.Close()
+			session.closeTransport()
+			return
+		} else if err != nil {
+			return
+		}
+		timer.Reset(session.KeepAliveInterval)
+	}
+}
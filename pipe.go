@@ -2,16 +2,20 @@ package spdy
 
 import (
 	"io"
+	"os"
+	"sync"
 )
 
 func Pipe(buffer int) (*PipeReader, *PipeWriter) {
-	p := &pipe{ch: make(chan Frame, buffer)}
+	p := &pipe{ch: make(chan Frame, buffer), done: make(chan bool)}
 	return &PipeReader{pipe: p}, &PipeWriter{pipe: p}
 }
 
 
 type pipe struct {
 	ch	chan Frame
+	done	chan bool	// Closed when the pipe is closed, to wake up readers and writers
+	lock	sync.Mutex	// Protects err and the frame counters
 	err	error
 }
 
@@ -27,25 +31,45 @@ type PipeWriter struct {
 
 
 func (p *pipe) CloseWithError(err error) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if p.err != nil {
 		return nil
 	}
 	p.err = err
-	close(p.ch)
+	close(p.done)
 	return nil
 }
 
+func (p *pipe) closeErr() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
 
 
 func (writer *PipeWriter) WriteFrame(frame Frame) error {
-	if writer.err != nil {
-		return writer.err
+	if err := writer.closeErr(); err != nil {
+		return err
+	}
+	select {
+		case writer.ch <- frame:
+		case <-writer.done:	return writer.closeErr()
 	}
-	writer.ch <- frame
+	writer.lock.Lock()
 	writer.NFrames += 1
+	writer.lock.Unlock()
 	return nil
 }
 
+/* Return the number of frames written so far */
+func (writer *PipeWriter) nFrames() int {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.NFrames
+}
+
 func (writer *PipeWriter) Close() error {
 	return writer.CloseWithError(io.EOF)
 }
@@ -53,16 +77,36 @@ func (writer *PipeWriter) Close() error {
 
 
 func (reader *PipeReader) ReadFrame() (Frame, error) {
-	/* This will not block if the channel is closed and empty */
-	frame, ok := <-reader.ch
-	if !ok {
-		return nil, reader.err
+	return reader.readFrame(nil)
+}
+
+/* Like ReadFrame, but fail with os.ErrDeadlineExceeded once `expired` is closed */
+func (reader *PipeReader) readFrame(expired chan bool) (Frame, error) {
+	var frame Frame
+	select {
+		case frame = <-reader.ch:
+		case <-expired:	return nil, os.ErrDeadlineExceeded
+		case <-reader.done: {
+			/* Frames written before the pipe was closed can still be read */
+			select {
+				case frame = <-reader.ch:
+				default:	return nil, reader.closeErr()
+			}
+		}
 	}
+	reader.lock.Lock()
 	reader.NFrames += 1
+	reader.lock.Unlock()
 	return frame, nil
 }
 
+/* Return the number of frames read so far */
+func (reader *PipeReader) nFrames() int {
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+	return reader.NFrames
+}
+
 func (reader *PipeReader) Close() error {
 	return reader.CloseWithError(io.ErrClosedPipe)
 }
-
@@ -0,0 +1,171 @@
+package spdy
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+ * A sessionPool holds the client sessions of a Transport, keyed by origin
+ * (scheme, host and port). Sessions are reused for as many concurrent requests
+ * as the server allows, and evicted once they are closed or received GOAWAY.
+ *
+ * The settings which a server asked to persist are replayed on the next sessions
+ * to the same origin.
+ */
+type sessionPool struct {
+	lock		sync.Mutex
+	sessions	map[string][]*Session
+	dialing		map[string]*dialCall
+	persisted	map[string][]SettingsFlagIdValue	// Persisted settings of evicted sessions
+}
+
+/* A dial in progress, shared by all the requests waiting for it */
+type dialCall struct {
+	done	chan bool
+	session	*Session
+	err	error
+	waiters	int	// Number of callers waiting for the dial. Protected by pool.lock
+	cancel	context.CancelFunc	// Cancels the dial, once nobody waits for it
+}
+
+/*
+ * Return a session to `key` which can initiate a new stream, or dial a new one with `dial`.
+ * Concurrent calls for the same key wait for a single dial. It runs with a context of its
+ * own, so that it isn't cancelled with the caller which started it: each caller stops
+ * waiting when its own `ctx` expires, and the session is pooled once dialed. Once the
+ * last caller stops waiting, the dial is cancelled, and the next caller dials again.
+ */
+func (pool *sessionPool) get(ctx context.Context, key string, dial func(context.Context) (*Session, error)) (*Session, error) {
+	pool.lock.Lock()
+	for _, session := range pool.sessions[key] {
+		if session.canInitiateStream() {
+			pool.lock.Unlock()
+			return session, nil
+		}
+	}
+	call, exists := pool.dialing[key]
+	if !exists {
+		dialCtx, cancel := context.WithCancel(context.Background())
+		call = &dialCall{done: make(chan bool), cancel: cancel}
+		if pool.dialing == nil {
+			pool.dialing = make(map[string]*dialCall)
+		}
+		pool.dialing[key] = call
+		go pool.dial(dialCtx, key, call, dial, pool.persistedSettings(key))
+	}
+	call.waiters++
+	pool.lock.Unlock()
+	select {
+		case <-call.done:
+			return call.session, call.err
+		case <-ctx.Done(): {
+			pool.leave(key, call)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+/* Stop waiting for the dial `call` to `key`. If nobody else waits for it, cancel it */
+func (pool *sessionPool) leave(key string, call *dialCall) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	call.cancel()
+	if pool.dialing[key] == call {
+		delete(pool.dialing, key)
+	}
+}
+
+/* Run the shared dial `call` to `key`, replay `persisted` on the session, and pool it */
+func (pool *sessionPool) dial(ctx context.Context, key string, call *dialCall, dial func(context.Context) (*Session, error), persisted []SettingsFlagIdValue) {
+	call.session, call.err = dial(ctx)
+	call.cancel()
+	if call.err == nil {
+		if call.err = call.session.ReplaySettings(persisted); call.err != nil {
+			/* The session won't be pooled: don't leak its connection */
+			call.session.Close()
+			call.session.closeTransport()
+		}
+	}
+
+	pool.lock.Lock()
+	if pool.dialing[key] == call {
+		delete(pool.dialing, key)
+	}
+	if call.err == nil {
+		if pool.sessions == nil {
+			pool.sessions = make(map[string][]*Session)
+		}
+		pool.sessions[key] = append(pool.sessions[key], call.session)
+		go pool.evictWhenDone(key, call.session)
+	}
+	pool.lock.Unlock()
+	close(call.done)
+}
+
+/* Remove `session` from the pool once it stops serving, remembering its persisted settings */
+func (pool *sessionPool) evictWhenDone(key string, session *Session) {
+	<-session.served
+	pool.lock.Lock()
+	if pool.persisted == nil {
+		pool.persisted = make(map[string][]SettingsFlagIdValue)
+	}
+	pool.persisted[key] = session.PersistedSettings()
+	pool.lock.Unlock()
+	pool.remove(key, session)
+}
+
+/*
+ * Return the settings to replay on a new session to `key`: those of the latest live
+ * session, if any. The caller must hold pool.lock.
+ */
+func (pool *sessionPool) persistedSettings(key string) []SettingsFlagIdValue {
+	if sessions := pool.sessions[key]; len(sessions) > 0 {
+		return sessions[len(sessions) - 1].PersistedSettings()
+	}
+	return pool.persisted[key]
+}
+
+func (pool *sessionPool) remove(key string, session *Session) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	sessions := pool.sessions[key]
+	for i, s := range sessions {
+		if s == session {
+			pool.sessions[key] = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(pool.sessions[key]) == 0 {
+		delete(pool.sessions, key)
+	}
+}
+
+/* Close the sessions which have no open streams, and evict them */
+func (pool *sessionPool) closeIdle() {
+	pool.lock.Lock()
+	var idle []*Session
+	for key, sessions := range pool.sessions {
+		var busy []*Session
+		for _, session := range sessions {
+			if session.NStreams() == 0 {
+				idle = append(idle, session)
+			} else {
+				busy = append(busy, session)
+			}
+		}
+		if len(busy) == 0 {
+			delete(pool.sessions, key)
+		} else {
+			pool.sessions[key] = busy
+		}
+	}
+	pool.lock.Unlock()
+	for _, session := range idle {
+		session.Close()
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"compress/zlib"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -40,6 +41,10 @@ func (frame *SettingsFrame) read(h ControlFrameHeader, f *Framer) error {
 	if err := binary.Read(f.r, binary.BigEndian, &numSettings); err != nil {
 		return err
 	}
+	/* Each setting takes 8 bytes: don't trust the count beyond the length of the frame */
+	if h.length < 4 || uint64(numSettings) * 8 > uint64(h.length - 4) {
+		return &Error{InvalidControlFrame, 0}
+	}
 	frame.FlagIdValues = make([]SettingsFlagIdValue, numSettings)
 	for i := uint32(0); i < numSettings; i++ {
 		if err := binary.Read(f.r, binary.BigEndian, &frame.FlagIdValues[i].Id); err != nil {
@@ -75,6 +80,11 @@ func (frame *GoAwayFrame) read(h ControlFrameHeader, f *Framer) error {
 	if err := binary.Read(f.r, binary.BigEndian, &frame.LastGoodStreamId); err != nil {
 		return err
 	}
+	if f.version >= Version3 {
+		if err := binary.Read(f.r, binary.BigEndian, &frame.Status); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -82,9 +92,26 @@ func (frame *HeadersFrame) read(h ControlFrameHeader, f *Framer) error {
 	return f.readHeadersFrame(h, frame)
 }
 
+func (frame *WindowUpdateFrame) read(h ControlFrameHeader, f *Framer) error {
+	frame.CFHeader = h
+	if err := binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
+		return err
+	}
+	if err := binary.Read(f.r, binary.BigEndian, &frame.DeltaWindowSize); err != nil {
+		return err
+	}
+	// Stream-ID 0 designates the whole session, since version 3.1
+	frame.StreamId &= 0x7fffffff
+	frame.DeltaWindowSize &= 0x7fffffff
+	return nil
+}
+
 func newControlFrame(frameType ControlFrameType) (controlFrame, error) {
 	ctor, ok := cframeCtor[frameType]
 	if !ok {
+		if frame := newExtensionFrame(frameType); frame != nil {
+			return frame, nil
+		}
 		return nil, &Error{Err: InvalidControlFrame}
 	}
 	return ctor(), nil
@@ -99,7 +126,31 @@ var cframeCtor = map[ControlFrameType]func() controlFrame{
 	TypePing:      func() controlFrame { return new(PingFrame) },
 	TypeGoAway:    func() controlFrame { return new(GoAwayFrame) },
 	TypeHeaders:   func() controlFrame { return new(HeadersFrame) },
-	// TODO(willchan): Add TypeWindowUpdate
+	TypeWindowUpdate: func() controlFrame { return new(WindowUpdateFrame) },
+}
+
+// minControlFrameLength returns the length of the fixed fields of a control frame,
+// which precede its header block, if any.
+func minControlFrameLength(frameType ControlFrameType, version uint16) uint32 {
+	switch frameType {
+	case TypeSynStream:
+		return 10
+	case TypeSynReply, TypeHeaders:
+		if version < Version3 {
+			return 6
+		}
+		return 4
+	case TypeRstStream, TypeWindowUpdate:
+		return 8
+	case TypeSettings, TypePing:
+		return 4
+	case TypeGoAway:
+		if version < Version3 {
+			return 4
+		}
+		return 8
+	}
+	return 0
 }
 
 func (f *Framer) uncorkHeaderDecompressor(payloadSize int64) error {
@@ -108,7 +159,7 @@ func (f *Framer) uncorkHeaderDecompressor(payloadSize int64) error {
 		return nil
 	}
 	f.headerReader = io.LimitedReader{R: f.r, N: payloadSize}
-	decompressor, err := zlib.NewReaderDict(&f.headerReader, []byte(HeaderDictionary))
+	decompressor, err := zlib.NewReaderDict(&f.headerReader, headerDictionary(f.version))
 	if err != nil {
 		return err
 	}
@@ -138,30 +189,113 @@ func (f *Framer) parseControlFrame(version uint16, frameType ControlFrameType) (
 	flags := ControlFlags((length & 0xff000000) >> 24)
 	length &= 0xffffff
 	header := ControlFrameHeader{version, frameType, flags, length}
+	if length > f.maxFramePayload() {
+		return nil, &Error{PayloadTooLarge, 0}
+	}
 	cframe, err := newControlFrame(frameType)
-	if err != nil {
-		return nil, err
+	if err != nil || version != f.version {
+		/* Skip the payload of unknown frames, to stay in sync with the stream */
+		frame := &UnknownFrame{CFHeader: header, Payload: make([]byte, length)}
+		if _, err := io.ReadFull(f.r, frame.Payload); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+	if length < minControlFrameLength(frameType, version) {
+		/* Skip the frame, rather than reading its fields from the next one */
+		if _, err := io.CopyN(ioutil.Discard, f.r, int64(length)); err != nil {
+			return nil, err
+		}
+		return nil, &Error{InvalidControlFrame, 0}
+	}
+	switch frameType {
+		/* Header blocks span the rest of the frame */
+		case TypeSynStream, TypeSynReply, TypeHeaders:	err = cframe.read(header, f)
+		default:					err = f.readFixedControlFrame(cframe, header)
 	}
-	if err = cframe.read(header, f); err != nil {
+	if err != nil {
+		if invalid, isInvalid := err.(*invalidExtension); isInvalid {
+			return invalid.frame, nil
+		}
 		return nil, err
 	}
 	return cframe, nil
 }
 
-func parseHeaderValueBlock(r io.Reader, streamId uint32) (http.Header, error) {
-	var numHeaders uint16
-	if err := binary.Read(r, binary.BigEndian, &numHeaders); err != nil {
+// readFixedControlFrame reads a control frame without a header block through the length
+// of its payload, then skips the bytes which it didn't read, so that the Framer stays in
+// sync with frames longer than their fields, such as SETTINGS with fewer entries than
+// their length allows.
+func (f *Framer) readFixedControlFrame(frame controlFrame, header ControlFrameHeader) error {
+	r := f.r
+	payload := &io.LimitedReader{R: r, N: int64(header.length)}
+	f.r = payload
+	err := frame.read(header, f)
+	f.r = r
+	if _, isProtocolError := err.(*Error); err != nil && !isProtocolError {
+		return err
+	}
+	if _, skipErr := io.Copy(ioutil.Discard, payload); skipErr != nil {
+		return skipErr
+	}
+	return err
+}
+
+// readHeaderLength reads a count or a length from a name/value header block.
+// Those are 16-bit wide in version 2, and 32-bit wide in version 3.
+func readHeaderLength(r io.Reader, version uint16) (uint32, error) {
+	if version >= Version3 {
+		var length uint32
+		err := binary.Read(r, binary.BigEndian, &length)
+		return length, err
+	}
+	var length uint16
+	err := binary.Read(r, binary.BigEndian, &length)
+	return uint32(length), err
+}
+
+func parseHeaderValueBlock(r io.Reader, version uint16, streamId uint32) (http.Header, error) {
+	return parseLimitedHeaderValueBlock(r, version, streamId, DefaultMaxHeaders, DefaultMaxHeaderBytes)
+}
+
+// parseLimitedHeaderValueBlock is like parseHeaderValueBlock, but fails with TooManyHeaders
+// if the block has more than maxHeaders headers, and with HeadersTooLarge if it is larger
+// than maxBytes once decompressed. Nothing is allocated beyond those limits.
+func parseLimitedHeaderValueBlock(r io.Reader, version uint16, streamId uint32, maxHeaders, maxBytes int) (http.Header, error) {
+	lengthSize := 2
+	if version >= Version3 {
+		lengthSize = 4
+	}
+	numHeaders, err := readHeaderLength(r, version)
+	if err != nil {
 		return nil, err
 	}
+	if numHeaders > uint32(maxHeaders) {
+		return nil, &Error{TooManyHeaders, streamId}
+	}
+	remaining := maxBytes - lengthSize
+	/* Read a name or a value, unless it doesn't fit in the remaining budget */
+	readString := func() ([]byte, error) {
+		length, err := readHeaderLength(r, version)
+		if err != nil {
+			return nil, err
+		}
+		remaining -= lengthSize
+		if remaining < 0 || length > uint32(remaining) {
+			return nil, &Error{HeadersTooLarge, streamId}
+		}
+		remaining -= int(length)
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
 	var e error
 	h := make(http.Header, int(numHeaders))
 	for i := 0; i < int(numHeaders); i++ {
-		var length uint16
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
-			return nil, err
-		}
-		nameBytes := make([]byte, length)
-		if _, err := io.ReadFull(r, nameBytes); err != nil {
+		nameBytes, err := readString()
+		if err != nil {
 			return nil, err
 		}
 		name := string(nameBytes)
@@ -172,11 +306,8 @@ func parseHeaderValueBlock(r io.Reader, streamId uint32) (http.Header, error) {
 		if h[name] != nil {
 			e = &Error{DuplicateHeaders, streamId}
 		}
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
-			return nil, err
-		}
-		value := make([]byte, length)
-		if _, err := io.ReadFull(r, value); err != nil {
+		value, err := readString()
+		if err != nil {
 			return nil, err
 		}
 		valueList := strings.Split(string(value), "\x00")
@@ -190,6 +321,73 @@ func parseHeaderValueBlock(r io.Reader, streamId uint32) (http.Header, error) {
 	return h, nil
 }
 
+// readHeaderBlock reads and decompresses a header block of payloadSize bytes,
+// and parses it with the limits of the Framer.
+//
+// If the block exceeds the limits, the rest of it is skipped, so that the next frame
+// can be read. The decompression context, which the peer shares across header blocks,
+// is lost then: the header blocks which follow fail with the same error.
+func (f *Framer) readHeaderBlock(payloadSize int64, streamId uint32) (http.Header, error) {
+	if f.headerLimitErr != "" {
+		if _, err := io.CopyN(ioutil.Discard, f.r, payloadSize); err != nil {
+			return nil, err
+		}
+		return nil, &Error{f.headerLimitErr, streamId}
+	}
+	maxHeaders, maxBytes := f.MaxHeaders, f.MaxHeaderBytes
+	if maxHeaders == 0 {
+		maxHeaders = DefaultMaxHeaders
+	}
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxHeaderBytes
+	}
+	block := &f.headerReader
+	reader := &countingReader{}
+	if f.headerCompressionDisabled {
+		block = &io.LimitedReader{R: f.r, N: payloadSize}
+		reader.r = block
+	} else {
+		if err := f.uncorkHeaderDecompressor(payloadSize); err != nil {
+			return nil, err
+		}
+		reader.r = f.headerDecompressor
+	}
+	headers, err := parseLimitedHeaderValueBlock(reader, f.version, streamId, maxHeaders, maxBytes)
+	if e, ok := err.(*Error); ok && (e.Err == TooManyHeaders || e.Err == HeadersTooLarge) {
+		if _, err := io.Copy(ioutil.Discard, block); err != nil {
+			return nil, err
+		}
+		if !f.headerCompressionDisabled {
+			f.headerLimitErr = e.Err
+		}
+	} else if !f.headerCompressionDisabled && (err == io.EOF || (err == nil && f.headerReader.N != 0)) {
+		err = &Error{WrongCompressedPayloadSize, 0}
+	}
+	f.rawHeaderIn.Add(reader.n)
+	f.compressedHeaderIn.Add(payloadSize)
+	return headers, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// maxFramePayload returns the largest frame payload accepted by the Framer.
+func (f *Framer) maxFramePayload() uint32 {
+	if f.MaxFramePayload == 0 || f.MaxFramePayload > DefaultMaxFramePayload {
+		return DefaultMaxFramePayload
+	}
+	return uint32(f.MaxFramePayload)
+}
+
 func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame) error {
 	frame.CFHeader = h
 	var err error
@@ -199,29 +397,22 @@ func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame)
 	if err = binary.Read(f.r, binary.BigEndian, &frame.AssociatedToStreamId); err != nil {
 		return err
 	}
-	if err = binary.Read(f.r, binary.BigEndian, &frame.Priority); err != nil {
+	var priority uint16
+	if err = binary.Read(f.r, binary.BigEndian, &priority); err != nil {
 		return err
 	}
-	frame.Priority >>= 14
-
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 10))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
+	if f.version >= Version3 {
+		frame.Priority = priority >> 13
+		frame.Slot = uint8(priority & 0xff)
+	} else {
+		frame.Priority = priority >> 14
 	}
 
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerReader.N == 0) || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
+	frame.Headers, err = f.readHeaderBlock(int64(h.length - 10), frame.StreamId)
 	if err != nil {
 		return err
 	}
-	// Remove this condition when we bump Version to 3.
-	if Version >= 3 {
+	if f.version >= Version3 {
 		for h := range frame.Headers {
 			if invalidReqHeaders[h] {
 				return &Error{InvalidHeaderPresent, frame.StreamId}
@@ -240,27 +431,19 @@ func (f *Framer) readSynReplyFrame(h ControlFrameHeader, frame *SynReplyFrame) e
 	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
 		return err
 	}
-	var unused uint16
-	if err = binary.Read(f.r, binary.BigEndian, &unused); err != nil {
-		return err
-	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 6))
-		if err != nil {
+	headerOffset := uint32(4)
+	if f.version < Version3 {
+		var unused uint16
+		if err = binary.Read(f.r, binary.BigEndian, &unused); err != nil {
 			return err
 		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerReader.N == 0) || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
+		headerOffset += 2
 	}
+	frame.Headers, err = f.readHeaderBlock(int64(h.length - headerOffset), frame.StreamId)
 	if err != nil {
 		return err
 	}
-	// Remove this condition when we bump Version to 3.
-	if Version >= 3 {
+	if f.version >= Version3 {
 		for h := range frame.Headers {
 			if invalidRespHeaders[h] {
 				return &Error{InvalidHeaderPresent, frame.StreamId}
@@ -279,28 +462,20 @@ func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) err
 	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
 		return err
 	}
-	var unused uint16
-	if err = binary.Read(f.r, binary.BigEndian, &unused); err != nil {
-		return err
-	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 6))
-		if err != nil {
+	headerOffset := uint32(4)
+	if f.version < Version3 {
+		var unused uint16
+		if err = binary.Read(f.r, binary.BigEndian, &unused); err != nil {
 			return err
 		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && ((err == io.EOF && f.headerReader.N == 0) || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
+		headerOffset += 2
 	}
+	frame.Headers, err = f.readHeaderBlock(int64(h.length - headerOffset), frame.StreamId)
 	if err != nil {
 		return err
 	}
 
-	// Remove this condition when we bump Version to 3.
-	if Version >= 3 {
+	if f.version >= Version3 {
 		var invalidHeaders map[string]bool
 		if frame.StreamId%2 == 0 {
 			invalidHeaders = invalidReqHeaders
@@ -328,6 +503,9 @@ func (f *Framer) parseDataFrame(streamId uint32) (*DataFrame, error) {
 	frame.StreamId = streamId
 	frame.Flags = DataFlags(length >> 24)
 	length &= 0xffffff
+	if length > f.maxFramePayload() {
+		return nil, &Error{PayloadTooLarge, 0}
+	}
 	frame.Data = make([]byte, length)
 	if _, err := io.ReadFull(f.r, frame.Data); err != nil {
 		return nil, err
@@ -0,0 +1,258 @@
+package spdy
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+/* Number of frames a stream can queue in the scheduler before its writes block */
+const maxQueuedFrames = 16
+
+/*
+ * Number of control frames which can be queued before their writes block, so that a
+ * peer which floods us with frames needing a reply, and doesn't read, is held back
+ */
+const maxQueuedControlFrames = 4096
+
+/* Number of priority levels: 4 in version 2 and 8 in version 3. 0 is the highest. */
+const nPriorities = 8
+
+/*
+ * A writeScheduler queues the frames sent on a session, and decides in which order
+ * they are written to the peer:
+ *
+ *  - Control frames (SYN_STREAM, RST_STREAM, SETTINGS, PING, GOAWAY, WINDOW_UPDATE...)
+ *    jump the queue, and are sent in the order they were written.
+ *  - SYN_REPLY, HEADERS and DATA frames are queued per stream. Streams with a higher
+ *    priority are drained first, and streams of the same priority take turns, one
+ *    frame at a time.
+ *
+ * SYN_STREAM is treated as a control frame, so that it precedes the other frames of
+ * its stream, and the frames of the stream it is associated to.
+ */
+type writeScheduler struct {
+	lock		sync.Mutex
+	changed		*sync.Cond	// Signaled when a frame is queued or sent, or the scheduler is closed
+	control		[]Frame
+	queues		map[uint32]*streamQueue	// Streams with queued frames
+	ready		[nPriorities][]*streamQueue	// The same streams, by priority, in turn order
+	priorities	map[uint32]uint16
+	discarded	map[uint32]bool	// Streams reset while they may still write: their frames are dropped until release
+	err		error
+}
+
+type streamQueue struct {
+	id		uint32
+	priority	uint16
+	frames		[]Frame
+	dropped		bool	// Set when the stream is reset, for the writers waiting on the queue
+}
+
+func newWriteScheduler() *writeScheduler {
+	scheduler := &writeScheduler{
+		queues:		make(map[uint32]*streamQueue),
+		priorities:	make(map[uint32]uint16),
+		discarded:	make(map[uint32]bool),
+	}
+	scheduler.changed = sync.NewCond(&scheduler.lock)
+	return scheduler
+}
+
+/*
+ * Queue `frame`. If the stream of `frame` already has too many frames queued, or
+ * too many control frames are queued, block until some of them are sent, or the
+ * scheduler is closed.
+ */
+func (scheduler *writeScheduler) WriteFrame(frame Frame) error {
+	return scheduler.writeFrame(context.Background(), frame)
+}
+
+/* Like WriteFrame, but give up with ctx.Err() if `ctx` is done before there is room for `frame` */
+func (scheduler *writeScheduler) writeFrame(ctx context.Context, frame Frame) error {
+	/* Wake up the wait for room if ctx expires */
+	stop := context.AfterFunc(ctx, func() {
+		scheduler.lock.Lock()
+		scheduler.changed.Broadcast()
+		scheduler.lock.Unlock()
+	})
+	defer stop()
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	if scheduler.err != nil {
+		return scheduler.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id, isStream := frame.GetStreamId()
+	switch f := frame.(type) {
+		case *SynReplyFrame, *HeadersFrame, *DataFrame:
+		case *SynStreamFrame: {
+			scheduler.priorities[f.StreamId] = f.Priority
+			isStream = false
+		}
+		case *RstStreamFrame: {
+			/* The peer will discard the frames of a reset stream: don't bother sending them */
+			scheduler.drop(f.StreamId)
+			isStream = false
+		}
+		default:
+			isStream = false
+	}
+	if isStream && scheduler.discarded[id] {
+		/* Written after the stream was reset */
+		return nil
+	}
+	if !isStream {
+		for len(scheduler.control) >= maxQueuedControlFrames {
+			scheduler.changed.Wait()
+			if scheduler.err != nil {
+				return scheduler.err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		scheduler.control = append(scheduler.control, frame)
+		scheduler.changed.Broadcast()
+		return nil
+	}
+	for {
+		queue, exists := scheduler.queues[id]
+		if !exists {
+			queue = &streamQueue{id: id, priority: scheduler.priorities[id]}
+			if queue.priority >= nPriorities {
+				queue.priority = nPriorities - 1
+			}
+			scheduler.queues[id] = queue
+			scheduler.ready[queue.priority] = append(scheduler.ready[queue.priority], queue)
+		}
+		if len(queue.frames) < maxQueuedFrames {
+			queue.frames = append(queue.frames, frame)
+			scheduler.changed.Broadcast()
+			return nil
+		}
+		scheduler.changed.Wait()
+		if scheduler.err != nil {
+			return scheduler.err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if queue.dropped {
+			/* The stream was reset while we waited: don't send anything after RST_STREAM */
+			return nil
+		}
+	}
+}
+
+/*
+ * Return the next frame to send, blocking until there is one.
+ * Once the scheduler is closed, the remaining frames are returned, then the error.
+ */
+func (scheduler *writeScheduler) ReadFrame() (Frame, error) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	for {
+		if len(scheduler.control) > 0 {
+			if len(scheduler.control) == maxQueuedControlFrames {
+				/* Wake up the writers waiting for room */
+				scheduler.changed.Broadcast()
+			}
+			frame := scheduler.control[0]
+			scheduler.control[0] = nil
+			scheduler.control = scheduler.control[1:]
+			return frame, nil
+		}
+		for priority := range scheduler.ready {
+			if len(scheduler.ready[priority]) == 0 {
+				continue
+			}
+			/* Take a frame from the first stream, and send it to the back of the line */
+			queue := scheduler.ready[priority][0]
+			frame := queue.frames[0]
+			queue.frames[0] = nil
+			queue.frames = queue.frames[1:]
+			scheduler.ready[priority] = scheduler.ready[priority][1:]
+			if len(queue.frames) > 0 {
+				scheduler.ready[priority] = append(scheduler.ready[priority], queue)
+			} else {
+				delete(scheduler.queues, queue.id)
+			}
+			scheduler.changed.Broadcast()
+			return frame, nil
+		}
+		if scheduler.err != nil {
+			return nil, scheduler.err
+		}
+		scheduler.changed.Wait()
+	}
+}
+
+/* Set the priority of stream `id`, for the frames it queues from now on */
+func (scheduler *writeScheduler) setPriority(id uint32, priority uint16) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	scheduler.priorities[id] = priority
+}
+
+/* Forget the priority of stream `id`, once it is closed. Its queued frames are still sent. */
+func (scheduler *writeScheduler) forget(id uint32) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	delete(scheduler.priorities, id)
+}
+
+/*
+ * Drop the frames which stream `id` writes from now on, until release is called. Frames
+ * which are already queued are dropped once RST_STREAM is written.
+ */
+func (scheduler *writeScheduler) discard(id uint32) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	scheduler.discarded[id] = true
+}
+
+/* Stop dropping the frames of stream `id`, once it doesn't write anymore */
+func (scheduler *writeScheduler) release(id uint32) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	delete(scheduler.discarded, id)
+}
+
+/* Discard the queued frames of stream `id`. The caller must hold scheduler.lock. */
+func (scheduler *writeScheduler) drop(id uint32) {
+	queue, exists := scheduler.queues[id]
+	if !exists {
+		return
+	}
+	delete(scheduler.queues, id)
+	queue.dropped = true
+	ready := scheduler.ready[queue.priority]
+	for i, q := range ready {
+		if q == queue {
+			scheduler.ready[queue.priority] = append(ready[:i:i], ready[i+1:]...)
+			break
+		}
+	}
+	scheduler.changed.Broadcast()
+}
+
+/*
+ * Stop accepting frames. Frames which are already queued can still be read,
+ * after which ReadFrame returns `err`.
+ */
+func (scheduler *writeScheduler) CloseWithError(err error) error {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	if scheduler.err == nil {
+		scheduler.err = err
+		scheduler.changed.Broadcast()
+	}
+	return nil
+}
+
+func (scheduler *writeScheduler) Close() error {
+	return scheduler.CloseWithError(io.EOF)
+}
@@ -2,85 +2,529 @@ package spdy
 
 import (
 	"log"
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
-func ListenAndServe(listener net.Listener, handler Handler) error {
+// Protocol names, as negotiated with NPN/ALPN during the TLS handshake.
+const (
+	ProtocolSPDY2  = "spdy/2"
+	ProtocolSPDY3  = "spdy/3"
+	ProtocolSPDY31 = "spdy/3.1"
+	ProtocolHTTP11 = "http/1.1"
+)
+
+// DefaultProtocols is the list of protocols advertised by ListenAndServeTLS
+// and DialTLS, most preferred first.
+var DefaultProtocols = []string{ProtocolSPDY31, ProtocolSPDY3, ProtocolSPDY2, ProtocolHTTP11}
+
+// ProtocolVersion returns the major and minor SPDY versions matching a
+// negotiated protocol name, or an error if it is not a SPDY protocol.
+func ProtocolVersion(proto string) (major uint16, minor uint16, err error) {
+	switch proto {
+		case ProtocolSPDY2:	return Version2, 0, nil
+		case ProtocolSPDY3:	return Version3, 0, nil
+		case ProtocolSPDY31:	return Version3, 1, nil
+	}
+	return 0, 0, &Error{UnsupportedProtocol, 0}
+}
+
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe methods
+// after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("spdy: Server closed")
+
+/*
+ * A Server accepts connections and serves them with a handler, keeping track of
+ * the live sessions so that it can shut them down.
+ *
+ * TLS connections which negotiated SPDY are served over SPDY. Those which negotiated
+ * http/1.1, or nothing at all, are passed to a standard net/http server running the
+ * same handler, so that one port can serve both protocols.
+ */
+type Server struct {
+	Addr		string		// TCP address to listen on. ":https" (or ":http" without TLS) if empty
+	Handler		http.Handler	// Handler to invoke. http.DefaultServeMux if nil
+	TLSConfig	*tls.Config	// Optional TLS config, used by ListenAndServeTLS
+	ReadTimeout	time.Duration	// Timeouts of HTTP/1.1 fallback connections
+	WriteTimeout	time.Duration
+	IdleTimeout	time.Duration	// Also the Session.IdleTimeout of SPDY sessions
+	HandshakeTimeout time.Duration	// Time allowed for the TLS handshake and the first SPDY frame
+	MaxConcurrentStreams uint32	// Session.MaxConcurrentStreams of SPDY sessions. No limit if 0
+	ErrorLog	*log.Logger	// Logger for connection errors. The log package's standard logger if nil
+	// Limits on the frames received from clients, as in Framer. The defaults apply if they are 0.
+	MaxHeaders	int
+	MaxHeaderBytes	int
+	MaxFramePayload	int
+	// Compression of the header blocks exchanged with clients. zlib.BestCompression if nil.
+	HeaderCompression	*HeaderCompression
+
+	lock		sync.Mutex
+	listeners	map[net.Listener]bool
+	fallbacks	map[*http.Server]bool
+	sessions	map[*Session]bool
+	closed		bool
+}
+
+/*
+ * Accept connections on `listener` and serve them, until the listener fails
+ * or the server is shut down. It always returns a non-nil error.
+ */
+func (srv *Server) Serve(listener net.Listener) error {
 	debug("Listening to %s\n", listener.Addr())
+	fallbackListener := newConnListener(listener.Addr())
+	defer fallbackListener.Close()
+	fallback := srv.newFallbackServer()
+	if !srv.track(listener, fallback) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer srv.untrack(listener, fallback)
+	go fallback.Serve(fallbackListener)
 	for {
 		conn, err := listener.Accept()
-		debug("New connection from %s\n", conn.RemoteAddr())
 		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
-		if _, err := Serve(conn, handler, true); err != nil {
+		debug("New connection from %s\n", conn.RemoteAddr())
+		/* Don't let a slow TLS handshake block the listener */
+		go srv.serveConn(conn, fallbackListener)
+	}
+}
+
+/* Serve a single connection, over SPDY if possible, or by passing it to `fallback` */
+func (srv *Server) serveConn(conn net.Conn, fallback *connListener) {
+	var session *Session
+	var err error
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		if srv.HandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(srv.HandshakeTimeout))
+		}
+		var isHTTP bool
+		isHTTP, err = negotiatedHTTP(tlsConn)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			srv.logf("spdy: TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		} else if isHTTP {
+			debug("Falling back to HTTP/1.1 for %s\n", conn.RemoteAddr())
+			fallback.push(conn)
+			return
+		}
+		session, err = serveTLS(tlsConn, srv.handler(), true, srv.setupSession)
+	} else {
+		session, err = serveVersion(conn, srv.handler(), true, Version, 0, srv.setupSession)
+	}
+	if err != nil {
+		srv.logf("spdy: Error while serving %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	if !srv.trackSession(session) {
+		session.Close()
+		session.closeTransport()
+		return
+	}
+	<-session.served
+	srv.untrackSession(session)
+}
+
+/* Apply the server's timeouts and limits to a new session and its framer */
+func (srv *Server) setupSession(session *Session, framer *Framer) error {
+	session.IdleTimeout = srv.IdleTimeout
+	session.HandshakeTimeout = srv.HandshakeTimeout
+	session.MaxConcurrentStreams = srv.MaxConcurrentStreams
+	framer.MaxHeaders = srv.MaxHeaders
+	framer.MaxHeaderBytes = srv.MaxHeaderBytes
+	framer.MaxFramePayload = srv.MaxFramePayload
+	return srv.HeaderCompression.apply(framer)
+}
+
+/* Listen on srv.Addr with TCP, and serve incoming connections */
+func (srv *Server) ListenAndServe() error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(listener)
+}
+
+/*
+ * Listen on srv.Addr with TLS, and serve incoming connections.
+ *
+ * The certificate is loaded from `certFile` and `keyFile`, which may be empty if
+ * srv.TLSConfig already has certificates. The protocols listed in srv.TLSConfig.NextProtos
+ * are advertised, or DefaultProtocols if empty.
+ */
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":https"
+	}
+	config := withProtocols(srv.TLSConfig)
+	if certFile != "" || keyFile != "" || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
 			return err
 		}
+		if config == srv.TLSConfig {
+			config = config.Clone()
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(tls.NewListener(listener, config))
+}
+
+/*
+ * Shut the server down gracefully: close all listeners, then shut down all live
+ * sessions (see Session.Shutdown) and HTTP/1.1 connections, and wait for them to drain.
+ *
+ * If `ctx` expires first, the remaining connections are closed and ctx.Err() is returned.
+ */
+func (srv *Server) Shutdown(ctx context.Context) error {
+	listeners, fallbacks, sessions := srv.close()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	results := make(chan error, len(fallbacks) + len(sessions))
+	for _, fallback := range fallbacks {
+		go func(fallback *http.Server) { results <- fallback.Shutdown(ctx) }(fallback)
+	}
+	for _, session := range sessions {
+		go func(session *Session) { results <- session.Shutdown(ctx) }(session)
+	}
+	var err error
+	for i := 0; i < len(fallbacks) + len(sessions); i++ {
+		if e := <-results; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+/* Close all listeners and connections immediately */
+func (srv *Server) Close() error {
+	listeners, fallbacks, sessions := srv.close()
+	var err error
+	for _, listener := range listeners {
+		if e := listener.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, fallback := range fallbacks {
+		fallback.Close()
+	}
+	for _, session := range sessions {
+		session.Close()
+		session.closeTransport()
+	}
+	return err
+}
+
+/* Mark the server as closed, and return what needs to be closed */
+func (srv *Server) close() ([]net.Listener, []*http.Server, []*Session) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.closed = true
+	var listeners []net.Listener
+	var fallbacks []*http.Server
+	var sessions []*Session
+	for listener := range srv.listeners {
+		listeners = append(listeners, listener)
+	}
+	for fallback := range srv.fallbacks {
+		fallbacks = append(fallbacks, fallback)
+	}
+	for session := range srv.sessions {
+		sessions = append(sessions, session)
+	}
+	return listeners, fallbacks, sessions
+}
+
+func (srv *Server) isClosed() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.closed
+}
+
+/* Register a listener and its fallback server. Return false if the server is closed. */
+func (srv *Server) track(listener net.Listener, fallback *http.Server) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.closed {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]bool)
+		srv.fallbacks = make(map[*http.Server]bool)
+	}
+	srv.listeners[listener] = true
+	srv.fallbacks[fallback] = true
+	return true
+}
+
+func (srv *Server) untrack(listener net.Listener, fallback *http.Server) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	delete(srv.listeners, listener)
+	delete(srv.fallbacks, fallback)
+}
+
+/* Register a live session. Return false if the server is closed. */
+func (srv *Server) trackSession(session *Session) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.closed {
+		return false
+	}
+	if srv.sessions == nil {
+		srv.sessions = make(map[*Session]bool)
+	}
+	srv.sessions[session] = true
+	return true
+}
+
+func (srv *Server) untrackSession(session *Session) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	delete(srv.sessions, session)
+}
+
+func (srv *Server) handler() http.Handler {
+	if srv.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return srv.Handler
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
 	}
-	return nil
 }
 
+/* Accept connections on `listener` and serve them with `handler`. See Server. */
+func ListenAndServe(listener net.Listener, handler Handler) error {
+	srv := &Server{Handler: handler}
+	return srv.Serve(listener)
+}
+
+/* Complete the TLS handshake on `conn`, and return true if it did not negotiate SPDY */
+func negotiatedHTTP(conn *tls.Conn) (bool, error) {
+	if err := conn.Handshake(); err != nil {
+		return false, err
+	}
+	proto := conn.ConnectionState().NegotiatedProtocol
+	return proto == "" || proto == ProtocolHTTP11, nil
+}
+
+/* Return a net/http server serving HTTP/1.1 with the same handler */
+func (srv *Server) newFallbackServer() *http.Server {
+	return &http.Server{
+		Handler:	srv.handler(),
+		ReadTimeout:	srv.ReadTimeout,
+		WriteTimeout:	srv.WriteTimeout,
+		IdleTimeout:	srv.IdleTimeout,
+		ErrorLog:	srv.ErrorLog,
+		// Disable HTTP/2: connections reaching this server did not negotiate it.
+		TLSNextProto:	make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+}
 
 func Serve(conn net.Conn, handler Handler, server bool) (*Session, error) {
-	framer, err := NewFramer(conn, conn)
+	return ServeVersion(conn, handler, server, Version, 0)
+}
+
+/* Start a session speaking a given protocol version over `conn` */
+func ServeVersion(conn net.Conn, handler Handler, server bool, major, minor uint16) (*Session, error) {
+	return serveVersion(conn, handler, server, major, minor, nil)
+}
+
+/*
+ * Like ServeVersion, but call `setup`, if not nil, on the session and its framer before
+ * serving it. If it fails, `conn` is closed.
+ */
+func serveVersion(conn net.Conn, handler Handler, server bool, major, minor uint16, setup func(*Session, *Framer) error) (*Session, error) {
+	framer, err := NewFramerVersion(conn, conn, major)
 	if err != nil {
 		return nil, err
 	}
 	session := NewSession(handler, server)
+	session.Version = major
+	session.MinorVersion = minor
+	session.transport = conn
+	if setup != nil {
+		if err := setup(session, framer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	go session.Serve(framer)
 	return session, nil
 }
 
-/* Listen on a TCP port, and pass new connections to a handler */
-func ListenAndServeTCP(addr string, handler Handler) error {
-	listener, err := net.Listen("tcp", addr)
+/*
+ * Complete the TLS handshake on `conn`, then start a session speaking the negotiated
+ * protocol version. If no SPDY version was negotiated, the connection is closed.
+ */
+func ServeTLS(conn *tls.Conn, handler Handler, server bool) (*Session, error) {
+	return serveTLS(conn, handler, server, nil)
+}
+
+func serveTLS(conn *tls.Conn, handler Handler, server bool, setup func(*Session, *Framer) error) (*Session, error) {
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	proto := conn.ConnectionState().NegotiatedProtocol
+	debug("Negotiated protocol: '%s'\n", proto)
+	major, minor, err := ProtocolVersion(proto)
 	if err != nil {
-		log.Fatal(err)
+		conn.Close()
+		return nil, err
 	}
-	return ListenAndServe(listener, handler)
+	return serveVersion(conn, handler, server, major, minor, setup)
+}
+
+/* Listen on a TCP port, and pass new connections to a handler */
+func ListenAndServeTCP(addr string, handler Handler) error {
+	srv := &Server{Addr: addr, Handler: handler}
+	return srv.ListenAndServe()
 }
 
 /* Connect to a remote tcp server and return a new Session */
 func DialTCP(addr string, handler Handler) (*Session, error) {
+	return DialContext(context.Background(), addr, nil, handler)
+}
+
+/*
+ * Connect to a remote server and return a new Session. The connection is made over TLS
+ * with `config` if it is not nil, and over plain TCP otherwise.
+ * If `ctx` expires before the connection is established (including the TLS handshake),
+ * DialContext fails with ctx.Err(). Once connected, `ctx` has no effect on the session.
+ */
+func DialContext(ctx context.Context, addr string, config *tls.Config, handler Handler) (*Session, error) {
+	return dialContext(ctx, addr, config, handler, nil)
+}
+
+/* Like DialContext, but call `setup`, if not nil, on the session and its framer before serving it */
+func dialContext(ctx context.Context, addr string, config *tls.Config, handler Handler, setup func(*Session, *Framer) error) (*Session, error) {
 	debug("Connecting to %s\n", addr)
-	conn, err := net.Dial("tcp", addr)
+	if config == nil {
+		conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return serveVersion(conn, handler, false, Version, 0, setup)
+	}
+	dialer := &tls.Dialer{Config: withProtocols(config)}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	return Serve(conn, handler, false)
+	return serveTLS(conn.(*tls.Conn), handler, false, setup)
 }
 
 func ListenAndServeTLS(addr, certFile, keyFile string, handler Handler) error {
-	if addr == "" {
-		addr = ":https"
-	}
+	srv := &Server{Addr: addr, Handler: handler}
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+/*
+ * Listen on a TCP port with TLS, and pass new connections to a handler.
+ * The protocols listed in config.NextProtos are advertised, or DefaultProtocols if empty.
+ */
+func ListenAndServeTLSConfig(addr string, config *tls.Config, handler Handler) error {
+	srv := &Server{Addr: addr, Handler: handler, TLSConfig: config}
+	return srv.ListenAndServeTLS("", "")
+}
+
+func DialTLS(addr string, handler Handler) (*Session, error) {
 	config := &tls.Config{}
-	config.NextProtos = []string{"spdy/2"}
+	config.InsecureSkipVerify = true //FIXME: load a root CA instead
+	return DialTLSConfig(addr, config, handler)
+}
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
+/*
+ * Connect to a remote tls server and return a new Session speaking the negotiated protocol.
+ * The protocols listed in config.NextProtos are advertised, or DefaultProtocols if empty.
+ */
+func DialTLSConfig(addr string, config *tls.Config, handler Handler) (*Session, error) {
+	if config == nil {
+		config = &tls.Config{}
 	}
+	return DialContext(context.Background(), addr, config, handler)
+}
 
-	conn, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+/* Return a copy of `config` advertising DefaultProtocols, unless it already advertises protocols */
+func withProtocols(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if len(config.NextProtos) != 0 {
+		return config
 	}
+	config = config.Clone()
+	config.NextProtos = DefaultProtocols
+	return config
+}
 
-	tlsListener := tls.NewListener(conn, config)
-	return ListenAndServe(tlsListener, handler)
+/*
+ * connListener is a net.Listener which hands out connections accepted elsewhere.
+ * It is used to pass TLS connections which did not negotiate SPDY to net/http.
+ */
+type connListener struct {
+	addr	net.Addr
+	conns	chan net.Conn
+	closed	chan bool
+	once	sync.Once
 }
 
-func DialTLS(addr string, handler Handler) (*Session, error) {
-	config := &tls.Config{}
-	config.NextProtos = []string{"spdy/2"}
-	config.InsecureSkipVerify = true //FIXME: load a root CA instead
-	conn, err := tls.Dial("tcp", addr, config)
-	if err != nil {
-		return nil, err
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:	addr,
+		conns:	make(chan net.Conn),
+		closed:	make(chan bool),
 	}
-	return Serve(conn, handler, false)
+}
+
+/* Pass `conn` to the next call to Accept. If the listener is closed, `conn` is closed instead. */
+func (l *connListener) push(conn net.Conn) {
+	select {
+		case l.conns <- conn:
+		case <-l.closed:	conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+		case conn := <-l.conns:	return conn, nil
+		case <-l.closed:	return nil, errors.New("Listener closed")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
 }
@@ -9,9 +9,15 @@
 package spdy
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -28,39 +34,203 @@ import (
 
 type Session struct {
 	Server       bool   // Are we the server? (necessary for stream ID numbering)
+	Version      uint16 // Protocol version spoken on this session (Version2 or Version3)
+	MinorVersion uint16 // Minor protocol version (eg. 1 for SPDY/3.1)
 	lastStreamIdOut uint32 // Last (and highest-numbered) stream ID we allocated
+	lastSynIdOut	uint32 // Last (and highest-numbered) stream ID whose SYN_STREAM we sent
 	lastStreamIdIn	uint32 // Last (and highest-numbered) stream ID we received
+	peerLimitKnown	bool   // Did the peer send SettingsMaxConcurrentStreams? Protected by lock
+	lastIdBeforeLimit uint32 // Last stream ID we allocated before that. Protected by lock
 	streams      map[uint32]*Stream
-	handler      http.Handler
+	opening      map[uint32]bool // Local streams which have yet to send SYN_STREAM. They are also in streams
+	handler      StreamHandler // Called with each stream opened by the peer
 	closed       bool
-	outputR	     *PipeReader
-	outputW      *PipeWriter
+	output       *writeScheduler // Frames to send to the peer
+	initialSendWindow int32 // Initial flow control window of new streams, as set by the peer
+	initialRecvWindow int32 // Initial flow control window of new streams, as advertised to the peer
+	sendWindow   *sendWindow // Session-wide flow control (version 3.1 and up)
+	recvWindow   *recvWindow
+	// Size of the session-wide receive window, in bytes (version 3.1 and up).
+	// It can only be larger than DefaultInitialWindowSize, and must be set before Serve.
+	SessionWindowSize int32
+	settings      map[SettingsId]SettingsFlagIdValue // Settings received from the peer
+	localSettings map[SettingsId]SettingsFlagIdValue // Settings advertised to the peer
+	persisted     map[SettingsId]SettingsFlagIdValue // Settings the peer asked us to persist
+	settingsLock  sync.Mutex
+	// Maximum number of concurrent streams the peer may open. Excess streams are refused.
+	// 0 means no limit. Set it before Serve, which advertises it: afterwards, change it by
+	// sending SettingsMaxConcurrentStreams with SendSettings. Protected by lock.
+	MaxConcurrentStreams uint32
+	// If true, InitiateStream waits until the peer's SettingsMaxConcurrentStreams allows
+	// a new stream. Otherwise it fails immediately with TooManyStreams.
+	WaitForStreams bool
+	lock          sync.Mutex // Protects streams, closed and the stream states
+	synLock       sync.Mutex // Serializes SYN_STREAM frames, so that their ids increase. Taken before lock
+	streamsChanged *sync.Cond // Signaled when a stream is closed, or the limits change
+	goingAway     bool   // Did we send GOAWAY?
+	peerGoingAway bool   // Did the peer send GOAWAY?
+	transport     io.Closer // Underlying connection, closed when the session ends
+	serving       bool
+	served        chan bool // Closed when Serve returns
+	ctx           context.Context // Parent of the stream contexts, cancelled when the session is closed
+	cancel        context.CancelFunc
+	// Called with each resource pushed by the server, on client sessions.
+	// It must close resp.Body. If nil, pushed streams are cancelled.
+	// Set it before Serve, or with SetPushHandler once the session is served.
+	PushHandler   func(req *http.Request, resp *http.Response)
+	accepted      chan *Stream // Streams waiting for Accept, on sessions without a handler. Protected by lock
+	// If set on a session without a handler, the streams opened by the peer wait for
+	// Accept from the start. Otherwise, they are refused until Accept is first called.
+	// Set it before Serve.
+	AcceptStreams bool
+	pings         map[uint32]chan bool // Pings waiting for a reply, by id
+	lastPingId    uint32
+	pingLock      sync.Mutex
+	lastReceived  atomic.Int64 // When the last frame was received from the peer, in Unix nanoseconds
+	// If set, the peer is pinged after this long without receiving anything, and the
+	// session is closed if it doesn't reply within KeepAliveTimeout (KeepAliveInterval if 0).
+	// They must be set before Serve.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	// If set, the session is shut down after this long without open streams.
+	IdleTimeout   time.Duration
+	// If set, the session and its transport are closed if no frame is received this
+	// long after Serve starts. Only useful on servers: clients speak first.
+	HandshakeTimeout time.Duration
+	idleSince     time.Time // When the last stream was closed. Protected by lock
+	// Called with each frame of a type registered with RegisterControlFrame, from the
+	// goroutine reading frames: it must not block. If nil, those frames are ignored.
+	// Set it before Serve, or with SetExtensionHandler once the session is served.
+	ExtensionHandler func(frame *ExtensionFrame)
+	// If set, new streams compress the DATA frames they send (see Stream.CompressData).
+	// The peer must support DataFlagCompressed, which only exists in version 2: it is
+	// ignored in version 3 and up.
+	CompressData  bool
+	// If set, streams on which the peer sends compressed DATA frames are reset.
+	RefuseCompressedData bool
+	framer        *Framer // Set by Serve, if the peer is a Framer
+	framerPayload uint32 // Payload limit of the Framer which Serve reads from, if any
 }
 
 
+/* How long Serve waits for the GOAWAY frame to be sent after a protocol error */
+const goAwayFlushTimeout = time.Second
+
 func NewSession(handler http.Handler, server bool) *Session {
-	outputR, outputW := Pipe(4096)
+	return NewStreamSession(HTTPHandler(handler), server)
+}
+
+/*
+ * Create a session which passes the streams opened by the peer to `handler`, without
+ * parsing them as HTTP requests. If `handler` is nil, the streams wait for Accept if
+ * session.AcceptStreams is set, or once Accept is called. Otherwise they are refused.
+ */
+func NewStreamSession(handler StreamHandler, server bool) *Session {
+	output := newWriteScheduler()
 	session := &Session{
 		Server:		server,
+		Version:	Version,
 		streams:	make(map[uint32]*Stream),
+		opening:	make(map[uint32]bool),
 		handler:	handler,
-		outputR:	outputR,
-		outputW:	outputW,
-	}
-	if session.handler == nil {
-		session.outputW.WriteFrame(&GoAwayFrame{})
+		output:		output,
+		initialSendWindow: DefaultInitialWindowSize,
+		initialRecvWindow: DefaultInitialWindowSize,
+		sendWindow:	newSendWindow(DefaultInitialWindowSize),
+		SessionWindowSize: DefaultInitialWindowSize,
+		settings:	make(map[SettingsId]SettingsFlagIdValue),
+		localSettings:	make(map[SettingsId]SettingsFlagIdValue),
+		persisted:	make(map[SettingsId]SettingsFlagIdValue),
+		served:		make(chan bool),
+		pings:		make(map[uint32]chan bool),
 	}
+	session.recvWindow = newRecvWindow(0, DefaultInitialWindowSize, output, nil)
+	session.ctx, session.cancel = context.WithCancel(context.Background())
+	session.streamsChanged = sync.NewCond(&session.lock)
 	return session
 }
 
 func (session *Session) Close() {
+	session.lock.Lock()
 	session.closed = true
+	ids := make([]uint32, 0, len(session.streams))
 	for id := range session.streams {
+		ids = append(ids, id)
+	}
+	session.streamsChanged.Broadcast()
+	session.lock.Unlock()
+	session.sendWindow.close()
+	for _, id := range ids {
 		session.CloseStream(id)
 	}
+	session.cancel()
+	/* Let queued frames drain, then stop Serve */
+	session.output.Close()
+}
+
+/*
+ * Shut the session down gracefully: send GOAWAY, refuse new streams, and wait for open
+ * streams to complete before closing the session and its transport.
+ *
+ * If `ctx` expires first, open streams are closed abruptly and ctx.Err() is returned.
+ */
+func (session *Session) Shutdown(ctx context.Context) error {
+	session.goAway(ctx, GoAwayOK, nil)
+	idle := make(chan bool)
+	go func() {
+		session.lock.Lock()
+		for len(session.streams) > 0 && !session.closed {
+			session.streamsChanged.Wait()
+		}
+		session.lock.Unlock()
+		close(idle)
+	}()
+	select {
+		case <-idle:
+		case <-ctx.Done(): {
+			session.Close()
+			session.closeTransport()
+			return ctx.Err()
+		}
+	}
+	session.Close()
+	session.lock.Lock()
+	serving := session.serving || session.transport != nil
+	session.lock.Unlock()
+	if !serving {
+		return nil
+	}
+	/* Serve closes the transport once GOAWAY is flushed */
+	select {
+		case <-session.served:
+		case <-ctx.Done(): {
+			session.closeTransport()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (session *Session) closeTransport() {
+	if session.transport != nil {
+		session.transport.Close()
+	}
+}
+
+/* Return the header compression statistics of the connection, if the session is served over a Framer */
+func (session *Session) HeaderStats() HeaderStats {
+	session.lock.Lock()
+	framer := session.framer
+	session.lock.Unlock()
+	if framer == nil {
+		return HeaderStats{}
+	}
+	return framer.HeaderStats()
 }
 
 func (session *Session) Closed() bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
 	return session.closed
 }
 
@@ -109,52 +279,330 @@ func (session *Session) nextIdIn() (uint32, error) {
 
 /*
 ** InitiateStream() initiates a new local stream. It does not send SYN_STREAM or
-** any other frame. That is the responsibility of the caller. 
+** any other frame. That is the responsibility of the caller.
+**
+** The stream id is allocated right away, and never changes. Ids must increase in the
+** order SYN_STREAM frames are sent, though: if a stream initiated later sends SYN_STREAM
+** first, this stream can't be opened anymore, and Syn fails with InvalidStreamId.
+** OpenStream doesn't have this problem.
+**
+** If the peer's SettingsMaxConcurrentStreams is reached, InitiateStream fails with
+** TooManyStreams, or waits for a stream to close if session.WaitForStreams is set.
+** Once either side sent GOAWAY, or the session is closed, it fails with SessionGoingAway.
 */
 
 func (session *Session) InitiateStream() (*Stream, error) {
-	newId, err := session.nextIdOut()
+	return session.initiateStream(context.Background(), false, nil)
+}
+
+/*
+** InitiateUnidirectionalStream() is like InitiateStream, but the stream is flagged
+** UNIDIRECTIONAL: only we can send on it. It is half-closed on the receiving side
+** from the start, and a SYN_REPLY or DATA frame from the peer resets it with ProtocolError.
+*/
+
+func (session *Session) InitiateUnidirectionalStream() (*Stream, error) {
+	return session.initiateStream(context.Background(), true, nil)
+}
+
+/*
+** OpenStream() initiates a new local stream like InitiateStream, and sends its SYN_STREAM
+** with `headers`. The id is allocated as the SYN_STREAM is sent, so streams can be opened
+** concurrently. If session.WaitForStreams is set, it waits at most until `ctx` expires.
+** If `ctx` is cancelled before the stream ends, the stream is reset with Cancel, and
+** reads from it fail with ctx.Err().
+*/
+
+func (session *Session) OpenStream(ctx context.Context, headers *http.Header) (*Stream, error) {
+	return session.openStream(ctx, headers, false)
+}
+
+func (session *Session) openStream(ctx context.Context, headers *http.Header, fin bool) (*Stream, error) {
+	stream, err := session.initiateStream(ctx, false, newSynStreamFrame(headers, fin))
 	if err != nil {
 		return nil, err
 	}
-	if stream, err := session.newStream(newId, true); err != nil {
+	stop := context.AfterFunc(ctx, func() {
+		stream.abort(Cancel, ctx.Err())
+	})
+	context.AfterFunc(stream.Context(), func() { stop() })
+	return stream, nil
+}
+
+/*
+ * Initiate a new local stream. If `syn` is not nil, it is sent as the SYN_STREAM of the
+ * stream, with the id allocated to it.
+ */
+func (session *Session) initiateStream(ctx context.Context, unidirectional bool, syn *SynStreamFrame) (*Stream, error) {
+	/* Wake up the wait for a stream if ctx expires */
+	stop := context.AfterFunc(ctx, func() {
+		session.lock.Lock()
+		session.streamsChanged.Broadcast()
+		session.lock.Unlock()
+	})
+	defer stop()
+	if syn != nil {
+		session.synLock.Lock()
+		defer session.synLock.Unlock()
+	}
+	session.lock.Lock()
+	for {
+		if err := ctx.Err(); err != nil {
+			session.lock.Unlock()
+			return nil, err
+		}
+		if session.closed || session.goingAway || session.peerGoingAway {
+			session.lock.Unlock()
+			return nil, &Error{SessionGoingAway, 0}
+		}
+		if !session.maxStreamsOut() {
+			break
+		}
+		if !session.WaitForStreams {
+			session.lock.Unlock()
+			return nil, &Error{TooManyStreams, 0}
+		}
+		if syn == nil {
+			session.streamsChanged.Wait()
+			continue
+		}
+		/* Let the streams which are already initiated send SYN_STREAM while we wait */
+		session.synLock.Unlock()
+		session.streamsChanged.Wait()
+		session.lock.Unlock()
+		session.synLock.Lock()
+		session.lock.Lock()
+	}
+	stream, err := session.newStream(0, true, unidirectional)
+	if err != nil || syn == nil {
+		session.lock.Unlock()
+		return stream, err
+	}
+	syn.StreamId = stream.Id
+	if err := session.writeSyn(ctx, stream, syn); err != nil {
+		session.CloseStream(stream.Id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+/*
+ * Open a unidirectional stream to push a resource associated with the remote stream
+ * `associatedTo`, and send its SYN_STREAM with `headers`. Only servers can push.
+ *
+ * The SYN_STREAM is queued before initiatePush returns, so that it reaches the peer
+ * before any frame sent afterwards on the associated stream.
+ */
+func (session *Session) initiatePush(associatedTo uint32, headers *http.Header) (*Stream, error) {
+	if !session.Server {
+		return nil, errors.New("Only servers can push streams")
+	}
+	session.synLock.Lock()
+	defer session.synLock.Unlock()
+	session.lock.Lock()
+	var err error
+	if _, exists := session.streams[associatedTo]; !exists {
+		err = &Error{NoSuchStream, associatedTo}
+	} else if session.closed || session.goingAway || session.peerGoingAway {
+		err = &Error{SessionGoingAway, 0}
+	} else if session.maxStreamsOut() {
+		err = &Error{TooManyStreams, 0}
+	}
+	if err != nil {
+		session.lock.Unlock()
 		return nil, err
-	} else {
-		return stream, nil
 	}
-	return nil, nil
+	stream, err := session.newStream(0, true, true)
+	if err != nil {
+		session.lock.Unlock()
+		return nil, err
+	}
+	stream.associatedTo = associatedTo
+	syn := newSynStreamFrame(headers, false)
+	syn.StreamId = stream.Id
+	syn.AssociatedToStreamId = associatedTo
+	syn.CFHeader.Flags |= ControlFlagUnidirectional
+	if err := session.writeSyn(stream.Context(), stream, syn); err != nil {
+		session.CloseStream(stream.Id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+/*
+ * Send the SYN_STREAM of the local stream `stream`, initiated with InitiateStream.
+ *
+ * If a stream initiated after `stream` already sent its SYN_STREAM, ids can't go back:
+ * `stream` is de-registered, and the call fails with InvalidStreamId.
+ */
+func (session *Session) sendSyn(stream *Stream, frame *SynStreamFrame) error {
+	session.synLock.Lock()
+	defer session.synLock.Unlock()
+	session.lock.Lock()
+	id := stream.Id
+	streamPeer, exists := session.streams[id]
+	if !exists || !session.opening[id] {
+		/* Already opened, or closed: let the stream report the error */
+		session.lock.Unlock()
+		return stream.writeFrame(frame)
+	}
+	if session.peerGoingAway {
+		/* No stream can be opened after GOAWAY */
+		session.lock.Unlock()
+		return &Error{StreamNotProcessed, id}
+	}
+	if id <= session.lastSynIdOut {
+		session.lock.Unlock()
+		debug("Stream %d is opened after stream %d: refusing it", id, session.lastSynIdOut)
+		err := &Error{InvalidStreamId, id}
+		session.dropStream(streamPeer, err)
+		return err
+	}
+	frame.StreamId = id
+	/* Give up if the stream is closed while the frame waits for room */
+	return session.writeSyn(stream.Context(), stream, frame)
+}
+
+/*
+ * Queue the SYN_STREAM of local stream `stream`, which has yet to send it, unless `ctx`
+ * is done first. The caller must hold session.synLock and session.lock: session.lock is
+ * released before the frame is queued.
+ *
+ * The frame is written straight to the session output, rather than through the stream,
+ * so that it is queued before writeSyn returns.
+ */
+func (session *Session) writeSyn(ctx context.Context, stream *Stream, frame *SynStreamFrame) error {
+	/* Check the frame, and update the state of the stream. The frame is not sent twice: see streamWriter */
+	if err := stream.writeFrame(frame); err != nil {
+		session.lock.Unlock()
+		return err
+	}
+	delete(session.opening, frame.StreamId)
+	session.lastSynIdOut = frame.StreamId
+	session.lock.Unlock()
+	return session.output.writeFrame(ctx, frame)
+}
+
+/* Writes the frames of a stream to the session output */
+type streamWriter struct {
+	session	*Session
+}
+
+func (w *streamWriter) WriteFrame(frame Frame) error {
+	if _, isSyn := frame.(*SynStreamFrame); isSyn {
+		/* Already sent by sendSyn */
+		return nil
+	}
+	if id, _ := frame.GetStreamId(); w.session.isOpening(id) {
+		/* Eg. RST_STREAM on a stream which never sent SYN_STREAM: the peer doesn't know it */
+		return nil
+	}
+	return w.session.output.WriteFrame(frame)
+}
+
+/*
+ * Check that a pushed stream from the peer is valid: we must be the client, the stream
+ * must be unidirectional, and associated with an open stream which we initiated.
+ */
+func (session *Session) checkPush(frame *SynStreamFrame) error {
+	if session.Server || frame.CFHeader.Flags&ControlFlagUnidirectional == 0 {
+		return &Error{InvalidStreamId, frame.StreamId}
+	}
+	associated, exists := session.getStream(frame.AssociatedToStreamId)
+	if !exists || !session.isLocalId(frame.AssociatedToStreamId) || associated.IsClosed() {
+		return &Error{NoSuchStream, frame.AssociatedToStreamId}
+	}
+	return nil
 }
 
+/* Return true if InitiateStream would succeed without waiting */
+func (session *Session) canInitiateStream() bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return !session.closed && !session.goingAway && !session.peerGoingAway && !session.maxStreamsOut()
+}
 
 /*
  * Create a new stream and register it at `id` in `session`
  *
+ * Local streams get the next local id: `id` must be 0.
  * If `id` is invalid or already registered, the call will fail.
+ * If the stream is remote and would exceed session.MaxConcurrentStreams, it is refused.
+ * If we sent GOAWAY, remote streams are refused with SessionGoingAway.
+ * If `unidirectional` is true, the stream is half-closed on the receiving side from the start.
+ * The caller must hold session.lock.
  */
 
-func (session *Session) newStream(id uint32, local bool) (*Stream, error) {
+func (session *Session) newStream(id uint32, local bool, unidirectional bool) (*Stream, error) {
 	/* If the ID is valid, register the stream. Otherwise, send a protocol error */
-	if !session.streamIdIsValid(id, local) {
+	if !local && !session.streamIdIsValid(id, local) {
 		return nil, &Error{InvalidStreamId, id}
 	}
+	if !local && session.goingAway {
+		return nil, &Error{SessionGoingAway, id}
+	}
+	if !local && session.MaxConcurrentStreams != 0 && session.nStreamsIn() >= int(session.MaxConcurrentStreams) {
+		/* The ID is used up, even though the stream is refused */
+		session.lastStreamIdIn = id
+		return nil, &Error{TooManyStreams, id}
+	}
+	if local {
+		var err error
+		if id, err = session.nextIdOut(); err != nil {
+			return nil, err
+		}
+	}
 	stream, streamPeer := NewStream(id, local)
+	stream.version = session.Version
+	stream.session = session
+	stream.CompressData = session.CompressData
+	ctx, cancel := context.WithCancel(session.ctx)
+	stream.ctx, stream.cancel = ctx, cancel
+	streamPeer.ctx, streamPeer.cancel = ctx, cancel
+	if unidirectional {
+		/* Only the initiator can send: the other side is half-closed from the start */
+		stream.unidirectional = true
+		if local {
+			streamPeer.finReceived = true
+			streamPeer.output.rstOnly = true
+		} else {
+			streamPeer.finSent = true
+			stream.output.rstOnly = true
+		}
+	}
+	if session.Version >= Version3 {
+		var sessionRecvWindow *recvWindow
+		if session.hasSessionFlowControl() {
+			sessionRecvWindow = session.recvWindow
+			stream.sessionWindow, streamPeer.sessionWindow = session.sendWindow, session.sendWindow
+		}
+		sendWindow := newSendWindow(session.initialSendWindow)
+		recvWindow := newRecvWindow(id, session.initialRecvWindow, session.output, sessionRecvWindow)
+		stream.sendWindow, streamPeer.sendWindow = sendWindow, sendWindow
+		stream.recvWindow, streamPeer.recvWindow = recvWindow, recvWindow
+	}
 	session.streams[id] = streamPeer
 	if local {
 		session.lastStreamIdOut = id
+		session.opening[id] = true
 	} else {
 		session.lastStreamIdIn = id
 	}
 	/* Copy stream output to session output */
 	go func() {
-		err := Copy(session.outputW, streamPeer)
+		err := Copy(&streamWriter{session}, streamPeer)
 		/* Close the stream if there's an error (inluding EOF) */
 		if err != nil {
 			session.CloseStream(id)
 		} else {
-			if streamPeer.Closed {
+			if streamPeer.IsClosed() {
 				session.CloseStream(id)
+			} else {
+				session.halfClose(id, true)
 			}
 		}
+		/* Nothing is written on the stream anymore: see resetStream */
+		session.output.release(id)
 	}()
 	return stream, nil
 }
@@ -188,67 +636,256 @@ func (session *Session) streamIdIsValid(id uint32, local bool) bool {
 
 
 func (session *Session) CloseStream(id uint32) error {
+	session.lock.Lock()
 	stream, exists := session.streams[id]
 	if !exists {
+		session.lock.Unlock()
 		return errors.New(fmt.Sprintf("No such stream: %v", id))
 	}
-	stream.Close()
 	delete(session.streams, id)
+	delete(session.opening, id)
+	if len(session.streams) == 0 {
+		session.idleSince = time.Now()
+	}
+	session.streamsChanged.Broadcast()
+	session.lock.Unlock()
+	session.output.forget(id)
+	stream.Close()
+	return nil
+}
+
+/*
+ * Record that one direction of stream `id` is done: we sent FIN if `sent` is true,
+ * otherwise the peer did. Once both directions are done, the stream is de-registered.
+ */
+func (session *Session) halfClose(id uint32, sent bool) {
+	session.lock.Lock()
+	streamPeer, exists := session.streams[id]
+	if !exists {
+		session.lock.Unlock()
+		return
+	}
+	if sent {
+		streamPeer.finSent = true
+	} else {
+		streamPeer.finReceived = true
+	}
+	done := streamPeer.finSent && streamPeer.finReceived
+	session.lock.Unlock()
+	if done {
+		debug("Stream %d is fully closed. De-registering", id)
+		session.CloseStream(id)
+	}
+}
+
+/* Return true if `id` is a local stream which has yet to send SYN_STREAM */
+func (session *Session) isOpening(id uint32) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.opening[id]
+}
+
+/*
+ * Reset local stream `id` with `status` after we sent FIN, and de-register it.
+ * If the frames before FIN are not all passed to the session output yet, which can take
+ * forever if the peer doesn't read, they are dropped: nothing is sent after RST_STREAM.
+ * If the stream is already fully closed, nothing is sent.
+ */
+func (session *Session) resetStream(id uint32, status StatusCode) error {
+	session.lock.Lock()
+	streamPeer, exists := session.streams[id]
+	if exists && !streamPeer.finSent {
+		/* The copy goroutine of the stream releases it once it is done: see newStream */
+		session.output.discard(id)
+	}
+	session.lock.Unlock()
+	if !exists {
+		return &Error{StreamClosed, id}
+	}
+	if err := session.output.WriteFrame(&RstStreamFrame{StreamId: id, Status: status}); err != nil {
+		return err
+	}
+	session.CloseStream(id)
 	return nil
 }
 
+/* Return the stream registered at `id`, if any */
+func (session *Session) getStream(id uint32) (*Stream, bool) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	stream, exists := session.streams[id]
+	return stream, exists
+}
+
 
 /*
 ** Return the number of open streams
 */
 
 func (session *Session) NStreams() int {
+	session.lock.Lock()
+	defer session.lock.Unlock()
 	return len(session.streams)
 }
 
+/* Return the number of open streams which were initiated locally. The caller must hold session.lock. */
+func (session *Session) nStreamsOut() int {
+	n := 0
+	for id := range session.streams {
+		if session.isLocalId(id) {
+			n++
+		}
+	}
+	return n
+}
+
+/* Return the number of open streams which were initiated by the peer. The caller must hold session.lock. */
+func (session *Session) nStreamsIn() int {
+	return len(session.streams) - session.nStreamsOut()
+}
+
+/* Return true if the peer's SettingsMaxConcurrentStreams is reached. The caller must hold session.lock. */
+func (session *Session) maxStreamsOut() bool {
+	max, exists := session.peerSetting(SettingsMaxConcurrentStreams)
+	return exists && session.nStreamsOut() >= int(max)
+}
+
 func (session *Session) ReadFrame() (Frame, error) {
-	return session.outputR.ReadFrame()
+	return session.output.ReadFrame()
 }
 
 func (session *Session) WriteFrame(frame Frame) error {
 	debug("Received frame: %#v", frame)
+	session.lastReceived.Store(time.Now().UnixNano())
 	/* Is this frame stream-specific? */
 	if streamId, exists := frame.GetStreamId(); exists {
 		/* SYN_STREAM frame: create the stream */
-		if _, ok := frame.(*SynStreamFrame); ok {
-			if stream, err := session.newStream(streamId, false); err != nil {
-				if e, sendable := err.(*Error); sendable {
-					if err := session.outputW.WriteFrame(e.ToFrame()); err != nil {
+		if syn, ok := frame.(*SynStreamFrame); ok {
+			if syn.AssociatedToStreamId != 0 {
+				if err := session.checkPush(syn); err != nil {
+					debug("Invalid pushed stream %d: %s", streamId, err)
+					session.output.WriteFrame(&RstStreamFrame{StreamId: streamId, Status: InvalidStream})
+					return nil
+				}
+			}
+			unidirectional := syn.CFHeader.Flags&ControlFlagUnidirectional != 0
+			session.lock.Lock()
+			stream, err := session.newStream(streamId, false, unidirectional)
+			pushHandler := session.PushHandler
+			if err == nil {
+				/* Our frames on the stream are scheduled with the priority chosen by the peer */
+				stream.Priority = syn.Priority
+				session.output.setPriority(streamId, syn.Priority)
+			}
+			session.lock.Unlock()
+			if err != nil {
+				if e, sendable := err.(*Error); sendable && e.Err == SessionGoingAway {
+					/* After sending GOAWAY, new streams are ignored */
+					debug("Ignoring stream %d after GOAWAY", streamId)
+					return nil
+				} else if sendable {
+					if err := session.output.WriteFrame(e.ToFrame()); err != nil {
 						return err
 					}
 					return nil
 				} else {
 					return err
 				}
+			} else if syn.AssociatedToStreamId != 0 {
+				go stream.servePush(pushHandler)
+			} else if session.handler == nil {
+				if !session.backlog(stream) {
+					/* Refuse the stream before its SYN_STREAM gets to it */
+					debug("Not accepting streams, or the backlog is full: refusing stream %d", streamId)
+					if streamPeer, exists := session.getStream(streamId); exists {
+						session.rejectStream(streamPeer, RefusedStream, &Error{TooManyStreams, streamId})
+					}
+					return nil
+				}
 			} else {
-				go stream.Serve(session.handler)
+				go session.handler.ServeStream(stream)
+			}
+		}
+		/* WINDOW_UPDATE frames are handled here, and not passed to the stream */
+		if update, ok := frame.(*WindowUpdateFrame); ok {
+			return session.updateWindow(update)
+		}
+		data, isData := frame.(*DataFrame)
+		if isData && session.hasSessionFlowControl() {
+			if !session.recvWindow.receive(len(data.Data)) {
+				debug("Session exceeded its flow control window")
+				return session.goAway(context.Background(), GoAwayProtocolError, &Error{FlowControlViolation, 0})
 			}
 		}
-		streamPeer, exists := session.streams[streamId]
+		streamPeer, exists := session.getStream(streamId)
 		if !exists {
-			session.outputW.WriteFrame(&RstStreamFrame{StreamId: streamId, Status: ProtocolError})
+			if isData && session.hasSessionFlowControl() {
+				/* Nobody will consume this data */
+				session.recvWindow.consume(len(data.Data))
+			}
+			if session.ignoredStream(streamId) || session.closedStream(streamId) {
+				return nil
+			}
+			session.output.WriteFrame(&RstStreamFrame{StreamId: streamId, Status: ProtocolError})
+			return nil
+		}
+		if isData && streamPeer.recvWindow != nil {
+			if !streamPeer.recvWindow.receive(len(data.Data)) {
+				debug("Stream %d exceeded its flow control window", streamId)
+				if session.hasSessionFlowControl() {
+					session.recvWindow.consume(len(data.Data))
+				}
+				session.output.WriteFrame((&Error{FlowControlViolation, streamId}).ToFrame())
+				session.CloseStream(streamId)
+				return nil
+			}
+		}
+		if frame.GetFinFlag() && streamPeer.recvWindow != nil {
+			/* The peer is done sending: no need to open the window anymore */
+			streamPeer.recvWindow.finish()
+		}
+		if _, isRst := frame.(*RstStreamFrame); streamPeer.output.rstOnly && !isRst {
+			/* The peer can't send on a unidirectional stream which we initiated */
+			debug("Received %#v on the closed side of unidirectional stream %d", frame, streamId)
+			session.rejectStream(streamPeer, ProtocolError, &Error{IllegalUnidirectional, streamId})
+			return nil
+		}
+		if isData && data.Flags&DataFlagCompressed != 0 && session.Version >= Version3 {
+			debug("Compressed data on stream %d: the flag only exists in version 2", streamId)
+			session.rejectStream(streamPeer, ProtocolError, &Error{InvalidDataFrame, streamId})
+			return nil
+		}
+		if isData && data.Flags&DataFlagCompressed != 0 && session.RefuseCompressedData {
+			debug("Refusing compressed data on stream %d", streamId)
+			session.rejectStream(streamPeer, ProtocolError, &Error{CompressedDataRefused, streamId})
 			return nil
 		}
 		err := streamPeer.WriteFrame(frame)
 		if err != nil {
-			debug("Error while passing frame to stream: %s. Closing stream.", err)
+			/*
+			 * We closed or reset the stream on our side: its input is gone, but the session
+			 * is fine. Closing the stream gives the discarded data back to the session window.
+			 */
+			debug("Stream %d is closed locally (%s): discarding %#v", streamId, err, frame)
 			session.CloseStream(streamId)
-			return err
-		} else if streamPeer.Closed {
+			return nil
+		} else if _, isRst := frame.(*RstStreamFrame); isRst || streamPeer.IsClosed() {
+			/* RST_STREAM ends the stream, even if the peer already sent FIN */
 			debug("Stream %d is fully closed. De-registering", streamId)
+			session.CloseStream(streamId)
+		} else if frame.GetFinFlag() {
+			session.halfClose(streamId, false)
 		}
 	/* Is this frame session-wide? */
 	} else {
 		switch frame.(type) {
-			case *SettingsFrame:		debug("SETTINGS\n")
+			case *SettingsFrame:		return session.applySettings(frame.(*SettingsFrame))
 			case *NoopFrame:		debug("NOOP\n")
-			case *PingFrame:		session.outputW.WriteFrame(frame)
-			case *GoAwayFrame:		debug("GOAWAY\n")
+			case *PingFrame:		return session.receivePing(frame.(*PingFrame))
+			case *GoAwayFrame:		session.receiveGoAway(frame.(*GoAwayFrame))
+			case *WindowUpdateFrame:	return session.updateWindow(frame.(*WindowUpdateFrame))
+			case *ExtensionFrame:		session.receiveExtension(frame.(*ExtensionFrame))
+			case *UnknownFrame:		return session.receiveUnknown(frame.(*UnknownFrame))
 			default:			debug("Unknown frame type!")
 		}
 	}
@@ -256,12 +893,264 @@ func (session *Session) WriteFrame(frame Frame) error {
 }
 
 
+/*
+ * Apply a WINDOW_UPDATE frame received from the peer to the send window of a stream.
+ * Updates for unknown streams are ignored: they may have been sent before the stream closed.
+ * A delta of 0 is a protocol error.
+ */
+func (session *Session) updateWindow(frame *WindowUpdateFrame) error {
+	if frame.StreamId == 0 {
+		if !session.hasSessionFlowControl() {
+			return nil
+		}
+		if frame.DeltaWindowSize == 0 {
+			return session.goAway(context.Background(), GoAwayProtocolError, &Error{InvalidWindowUpdate, 0})
+		}
+		if !session.sendWindow.add(int64(frame.DeltaWindowSize)) {
+			debug("WINDOW_UPDATE overflows the session window")
+			return session.goAway(context.Background(), GoAwayProtocolError, &Error{FlowControlViolation, 0})
+		}
+		return nil
+	}
+	streamPeer, exists := session.getStream(frame.StreamId)
+	if !exists || streamPeer.sendWindow == nil {
+		return nil
+	}
+	if frame.DeltaWindowSize == 0 {
+		debug("WINDOW_UPDATE with a delta of 0 on stream %d", frame.StreamId)
+		session.output.WriteFrame((&Error{InvalidWindowUpdate, frame.StreamId}).ToFrame())
+		session.CloseStream(frame.StreamId)
+		return nil
+	}
+	if !streamPeer.sendWindow.add(int64(frame.DeltaWindowSize)) {
+		debug("WINDOW_UPDATE overflows the window of stream %d", frame.StreamId)
+		session.output.WriteFrame((&Error{FlowControlViolation, frame.StreamId}).ToFrame())
+		session.CloseStream(frame.StreamId)
+	}
+	return nil
+}
+
+/* Return true if the session has a session-wide flow control window (version 3.1 and up) */
+func (session *Session) hasSessionFlowControl() bool {
+	return session.Version > Version3 || (session.Version == Version3 && session.MinorVersion >= 1)
+}
+
+/*
+ * Ignore a control frame which the framer doesn't know. The framer only knows frames of
+ * its own version: a SYN_STREAM of another version is refused with UNSUPPORTED_VERSION,
+ * rather than leaving the peer waiting for a reply.
+ */
+func (session *Session) receiveUnknown(frame *UnknownFrame) error {
+	if frame.Err != nil {
+		debug("Ignoring control frame of type %d: %s", frame.Type(), frame.Err)
+		return nil
+	}
+	if frame.Type() != TypeSynStream || len(frame.Payload) < 4 {
+		debug("Ignoring unknown control frame of type %d", frame.Type())
+		return nil
+	}
+	id := binary.BigEndian.Uint32(frame.Payload) & 0x7fffffff
+	debug("Refusing stream %d of version %d", id, frame.Version())
+	return session.output.WriteFrame(&RstStreamFrame{StreamId: id, Status: UnsupportedVersion})
+}
+
+/*
+ * Reset a stream with `status`, after the peer sent a frame it shouldn't have or
+ * we refused it, and de-register it. Reads and writes on the stream fail with `err`.
+ */
+func (session *Session) rejectStream(streamPeer *Stream, status StatusCode, err *Error) {
+	session.output.WriteFrame(&RstStreamFrame{StreamId: streamPeer.Id, Status: status})
+	session.dropStream(streamPeer, err)
+}
+
+/* De-register a stream without sending anything, and make reads and writes on it fail with `err` */
+func (session *Session) dropStream(streamPeer *Stream, err *Error) {
+	session.lock.Lock()
+	delete(session.streams, streamPeer.Id)
+	delete(session.opening, streamPeer.Id)
+	if len(session.streams) == 0 {
+		session.idleSince = time.Now()
+	}
+	session.streamsChanged.Broadcast()
+	session.lock.Unlock()
+	session.output.forget(streamPeer.Id)
+	streamPeer.closeWithError(err)
+}
+
+/*
+ * Send a GOAWAY frame, unless we already did, and return `err`.
+ * From then on, new streams from the peer are ignored.
+ * If too many control frames are queued, the frame is dropped once `ctx` is done.
+ */
+func (session *Session) goAway(ctx context.Context, status GoAwayStatus, err error) error {
+	session.lock.Lock()
+	if session.goingAway {
+		session.lock.Unlock()
+		return err
+	}
+	session.goingAway = true
+	lastGood := session.lastStreamIdIn
+	session.streamsChanged.Broadcast()
+	session.lock.Unlock()
+	session.output.writeFrame(ctx, &GoAwayFrame{LastGoodStreamId: lastGood, Status: status})
+	return err
+}
+
+/* Return true if frames for stream `id` should be ignored, because it was opened after we sent GOAWAY */
+func (session *Session) ignoredStream(id uint32) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.goingAway && !session.isLocalId(id) && id > session.lastStreamIdIn
+}
+
+/*
+ * Return true if stream `id` was opened, and is now closed. Its frames are ignored: they
+ * may have been sent before the peer received our RST_STREAM.
+ */
+func (session *Session) closedStream(id uint32) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.isLocalId(id) {
+		return id <= session.lastStreamIdOut
+	}
+	return id != 0 && id <= session.lastStreamIdIn
+}
+
+/*
+ * Handle a GOAWAY frame from the peer: no more streams can be initiated, and local
+ * streams above the last good stream id fail with StreamNotProcessed, since the peer
+ * will not process them. They can safely be retried on another session.
+ */
+func (session *Session) receiveGoAway(frame *GoAwayFrame) {
+	debug("GOAWAY (last good stream: %d, status: %d)\n", frame.LastGoodStreamId, frame.Status)
+	session.lock.Lock()
+	session.peerGoingAway = true
+	var unprocessed []*Stream
+	for id, streamPeer := range session.streams {
+		if session.isLocalId(id) && id > frame.LastGoodStreamId {
+			unprocessed = append(unprocessed, streamPeer)
+			delete(session.streams, id)
+			delete(session.opening, id)
+		}
+	}
+	session.streamsChanged.Broadcast()
+	session.lock.Unlock()
+	for _, streamPeer := range unprocessed {
+		session.output.forget(streamPeer.Id)
+		streamPeer.closeWithError(&Error{StreamNotProcessed, streamPeer.Id})
+	}
+}
+
+/* Send the first frames of the session, advertising our settings */
+func (session *Session) start() error {
+	session.lock.Lock()
+	maxStreams := session.MaxConcurrentStreams
+	session.lock.Unlock()
+	if maxStreams != 0 {
+		if err := session.SendSettings(SettingsFlagIdValue{0, SettingsMaxConcurrentStreams, maxStreams}); err != nil {
+			return err
+		}
+	}
+	if session.hasSessionFlowControl() {
+		if err := session.recvWindow.grow(session.SessionWindowSize); err != nil {
+			return err
+		}
+	}
+	if session.KeepAliveInterval > 0 {
+		go session.keepAlive()
+	}
+	if session.IdleTimeout > 0 {
+		session.lock.Lock()
+		session.idleSince = time.Now()
+		session.lock.Unlock()
+		go session.watchIdle()
+	}
+	if session.HandshakeTimeout > 0 {
+		timer := time.AfterFunc(session.HandshakeTimeout, func() {
+			if session.lastReceived.Load() == 0 {
+				debug("No frame received after %s: closing the session", session.HandshakeTimeout)
+				session.Close()
+				session.closeTransport()
+			}
+		})
+		context.AfterFunc(session.ctx, func() { timer.Stop() })
+	}
+	return nil
+}
+
+/* Shut the session down gracefully once it has no open streams for session.IdleTimeout */
+func (session *Session) watchIdle() {
+	timer := time.NewTimer(session.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+			case <-timer.C:
+			case <-session.ctx.Done():	return
+		}
+		session.lock.Lock()
+		var idle time.Duration
+		if len(session.streams) == 0 {
+			idle = time.Since(session.idleSince)
+		}
+		session.lock.Unlock()
+		if idle >= session.IdleTimeout {
+			debug("Session idle for %s: shutting down", idle)
+			session.goAway(session.ctx, GoAwayOK, nil)
+			session.Close()
+			return
+		}
+		timer.Reset(session.IdleTimeout - idle)
+	}
+}
+
+/*
+ * Exchange frames with `peer` until either side is done. The session and its
+ * transport are then closed.
+ */
 func (session *Session) Serve(peer ReadWriter) error {
+	session.lock.Lock()
+	session.serving = true
+	if framer, isFramer := peer.(*Framer); isFramer {
+		session.framer = framer
+		session.framerPayload = framer.maxFramePayload()
+	}
+	session.lock.Unlock()
+	defer close(session.served)
+	defer session.closeTransport()
 	defer session.Close()
-	if err := Splice(session, peer, true); err != nil {
+	if err := session.start(); err != nil {
 		return err
 	}
-	return nil
+	received, sent := make(chan error, 1), make(chan error, 1)
+	go func() { received <- Copy(session, peer) }()
+	go func() { sent <- Copy(peer, session) }()
+	select {
+		case err := <-sent:
+			return err
+		case err := <-received: {
+			/* The peer broke the protocol (or a limit of the framer): tell it before hanging up */
+			if _, isProtocolError := err.(*Error); isProtocolError {
+				debug("Protocol error: %s", err)
+				ctx, cancel := context.WithTimeout(context.Background(), goAwayFlushTimeout)
+				defer cancel()
+				session.goAway(ctx, GoAwayProtocolError, nil)
+				session.Close()
+				select {
+					case <-sent:
+					case <-ctx.Done():
+				}
+			}
+			return err
+		}
+	}
+}
+
+/* Return the largest payload the peer may send in a frame, as limited by the Framer which Serve reads from */
+func (session *Session) maxFramePayload() int {
+	if session.framerPayload == 0 {
+		return DefaultMaxFramePayload
+	}
+	return int(session.framerPayload)
 }
 
 /*
@@ -0,0 +1,189 @@
+package spdy
+
+import (
+	"context"
+	"sort"
+)
+
+/*
+ * Return the settings last received from the peer, sorted by id.
+ *
+ * Only SettingsMaxConcurrentStreams and SettingsInitialWindowSize are enforced.
+ * Other settings (round-trip time, bandwidth...) are hints, stored for the application's benefit.
+ */
+func (session *Session) Settings() []SettingsFlagIdValue {
+	session.settingsLock.Lock()
+	defer session.settingsLock.Unlock()
+	return sortedSettings(session.settings)
+}
+
+/* Return the settings we advertised to the peer with SendSettings, sorted by id. */
+func (session *Session) LocalSettings() []SettingsFlagIdValue {
+	session.settingsLock.Lock()
+	defer session.settingsLock.Unlock()
+	return sortedSettings(session.localSettings)
+}
+
+/*
+ * Return the settings which the server asked us to persist (with FlagSettingsPersistValue),
+ * flagged with FlagSettingsPersisted.
+ *
+ * Sessions don't remember them across connections: a client must store them, and pass
+ * them to ReplaySettings on its next session with the same host.
+ */
+func (session *Session) PersistedSettings() []SettingsFlagIdValue {
+	session.settingsLock.Lock()
+	defer session.settingsLock.Unlock()
+	return sortedSettings(session.persisted)
+}
+
+/*
+ * Advertise our own settings to the peer.
+ *
+ * SettingsMaxConcurrentStreams sets session.MaxConcurrentStreams, which is enforced on
+ * the streams opened by the peer from then on.
+ * In version 3 and up, SettingsInitialWindowSize resizes the receive window of all streams.
+ */
+func (session *Session) SendSettings(settings ...SettingsFlagIdValue) error {
+	session.settingsLock.Lock()
+	for _, setting := range settings {
+		if err := checkSetting(setting); err != nil {
+			session.settingsLock.Unlock()
+			return err
+		}
+	}
+	for _, setting := range settings {
+		session.localSettings[setting.Id] = setting
+	}
+	session.settingsLock.Unlock()
+	for _, setting := range settings {
+		switch setting.Id {
+			case SettingsInitialWindowSize:
+				if session.Version >= Version3 {
+					session.resizeRecvWindows(int32(setting.Value))
+				}
+			case SettingsMaxConcurrentStreams:
+				session.lock.Lock()
+				session.MaxConcurrentStreams = setting.Value
+				session.lock.Unlock()
+		}
+	}
+	return session.output.WriteFrame(&SettingsFrame{FlagIdValues: settings})
+}
+
+/*
+ * Send settings persisted from a previous session with the same server back to it,
+ * as returned by PersistedSettings. This should be done before opening any stream.
+ *
+ * Replayed settings are the server's, not ours: they are not applied locally, but they
+ * are persisted again on this session until the server clears them.
+ */
+func (session *Session) ReplaySettings(settings []SettingsFlagIdValue) error {
+	if len(settings) == 0 {
+		return nil
+	}
+	replayed := make([]SettingsFlagIdValue, 0, len(settings))
+	session.settingsLock.Lock()
+	for _, setting := range settings {
+		setting.Flag = FlagSettingsPersisted
+		session.persisted[setting.Id] = setting
+		replayed = append(replayed, setting)
+	}
+	session.settingsLock.Unlock()
+	return session.output.WriteFrame(&SettingsFrame{FlagIdValues: replayed})
+}
+
+/* Return the value of a setting received from the peer, if it was set */
+func (session *Session) peerSetting(id SettingsId) (uint32, bool) {
+	session.settingsLock.Lock()
+	defer session.settingsLock.Unlock()
+	setting, exists := session.settings[id]
+	return setting.Value, exists
+}
+
+/* Store and apply a SETTINGS frame received from the peer */
+func (session *Session) applySettings(frame *SettingsFrame) error {
+	for _, setting := range frame.FlagIdValues {
+		if err := checkSetting(setting); err != nil {
+			debug("Invalid setting from peer: %#v", setting)
+			return session.goAway(context.Background(), GoAwayProtocolError, err)
+		}
+	}
+	session.settingsLock.Lock()
+	if frame.CFHeader.Flags&ControlFlagSettingsClearSettings != 0 {
+		session.persisted = make(map[SettingsId]SettingsFlagIdValue)
+	}
+	for _, setting := range frame.FlagIdValues {
+		session.settings[setting.Id] = setting
+		if setting.Flag&FlagSettingsPersistValue != 0 && !session.Server {
+			session.persisted[setting.Id] = SettingsFlagIdValue{FlagSettingsPersisted, setting.Id, setting.Value}
+		}
+	}
+	session.settingsLock.Unlock()
+	for _, setting := range frame.FlagIdValues {
+		switch setting.Id {
+			case SettingsInitialWindowSize:
+				if session.Version >= Version3 {
+					session.resizeSendWindows(int32(setting.Value))
+				}
+			case SettingsMaxConcurrentStreams:
+				/* Wake up InitiateStream, in case the limit was raised */
+				session.lock.Lock()
+				if !session.peerLimitKnown {
+					session.peerLimitKnown = true
+					session.lastIdBeforeLimit = session.lastStreamIdOut
+				}
+				session.streamsChanged.Broadcast()
+				session.lock.Unlock()
+		}
+	}
+	return nil
+}
+
+/*
+ * Change the initial send window of streams to `size`. The windows of open streams
+ * are adjusted by the difference, and may become negative.
+ */
+func (session *Session) resizeSendWindows(size int32) {
+	session.lock.Lock()
+	delta := int64(size) - int64(session.initialSendWindow)
+	session.initialSendWindow = size
+	var overflows []uint32
+	for id, streamPeer := range session.streams {
+		if !streamPeer.sendWindow.add(delta) {
+			overflows = append(overflows, id)
+		}
+	}
+	session.lock.Unlock()
+	for _, id := range overflows {
+		debug("New initial window size overflows the window of stream %d", id)
+		session.output.WriteFrame((&Error{FlowControlViolation, id}).ToFrame())
+		session.CloseStream(id)
+	}
+}
+
+/* Change the initial receive window of streams to `size`, as advertised to the peer */
+func (session *Session) resizeRecvWindows(size int32) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.initialRecvWindow = size
+	for _, streamPeer := range session.streams {
+		streamPeer.recvWindow.resize(size)
+	}
+}
+
+func checkSetting(setting SettingsFlagIdValue) error {
+	if setting.Id == SettingsInitialWindowSize && setting.Value > MaxWindowSize {
+		return &Error{InvalidSettingValue, 0}
+	}
+	return nil
+}
+
+func sortedSettings(settings map[SettingsId]SettingsFlagIdValue) []SettingsFlagIdValue {
+	sorted := make([]SettingsFlagIdValue, 0, len(settings))
+	for _, setting := range settings {
+		sorted = append(sorted, setting)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Id < sorted[j].Id })
+	return sorted
+}
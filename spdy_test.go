@@ -7,14 +7,25 @@ package spdy
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"hash/adler32"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
 	"reflect"
 	"testing"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
@@ -48,10 +59,10 @@ func TestHeaderParsing(t *testing.T) {
 		"Version": []string{"http/1.1"},
 	}
 	var headerValueBlockBuf bytes.Buffer
-	writeHeaderValueBlock(&headerValueBlockBuf, headers)
+	writeHeaderValueBlock(&headerValueBlockBuf, Version, headers)
 
 	const bogusStreamId = 1
-	newHeaders, err := parseHeaderValueBlock(&headerValueBlockBuf, bogusStreamId)
+	newHeaders, err := parseHeaderValueBlock(&headerValueBlockBuf, Version, bogusStreamId)
 	if err != nil {
 		t.Fatal("parseHeaderValueBlock:", err)
 	}
@@ -61,9 +72,382 @@ func TestHeaderParsing(t *testing.T) {
 	}
 }
 
+func TestHeaderLimits(t *testing.T) {
+	headers := http.Header{
+		"Url":     []string{"http://www.google.com/"},
+		"Method":  []string{"get"},
+		"Version": []string{"http/1.1"},
+	}
+	var buf bytes.Buffer
+	writeHeaderValueBlock(&buf, Version3, headers)
+	block := buf.Bytes()
+	if _, err := parseLimitedHeaderValueBlock(bytes.NewReader(block), Version3, 1, 2, 1000); err == nil {
+		t.Errorf("Parsed too many headers")
+	} else if e, ok := err.(*Error); !ok || e.Err != TooManyHeaders {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := parseLimitedHeaderValueBlock(bytes.NewReader(block), Version3, 1, 3, len(block) - 1); err == nil {
+		t.Errorf("Parsed a header block larger than the limit")
+	} else if e, ok := err.(*Error); !ok || e.Err != HeadersTooLarge {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := parseLimitedHeaderValueBlock(bytes.NewReader(block), Version3, 1, 3, len(block)); err != nil {
+		t.Errorf("A header block of exactly the limit should be accepted: %s", err)
+	}
+	/* A huge length is rejected before allocating anything */
+	bomb := []byte{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}
+	if _, err := parseLimitedHeaderValueBlock(bytes.NewReader(bomb), Version3, 1, 10, 1000); err == nil {
+		t.Errorf("Parsed a header with a bogus length")
+	} else if e, ok := err.(*Error); !ok || e.Err != HeadersTooLarge {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestFramerHeaderLimits(t *testing.T) {
+	/* Header blocks of 300KB, which compress well or not */
+	large, random := make(http.Header), make(http.Header)
+	for i := 0; i < 10; i++ {
+		large.Set(fmt.Sprintf("X-Header-%d", i), strings.Repeat("a", 30000))
+		value := make([]byte, 15000)
+		rand.Read(value)
+		random.Set(fmt.Sprintf("X-Header-%d", i), fmt.Sprintf("%x", value))
+	}
+	many := make(http.Header)
+	for i := 0; i < 20; i++ {
+		many.Set(fmt.Sprintf("X-Header-%d", i), "a")
+	}
+	tests := []struct {
+		headers	http.Header
+		err	ErrorCode
+	}{{large, HeadersTooLarge}, {random, HeadersTooLarge}, {many, TooManyHeaders}}
+	for _, version := range []uint16{Version2, Version3} {
+		for _, test := range tests {
+			buffer := new(bytes.Buffer)
+			writer, _ := NewFramerVersion(buffer, buffer, version)
+			reader, _ := NewFramerVersion(buffer, buffer, version)
+			reader.MaxHeaders = 10
+			reader.MaxHeaderBytes = 100
+			writer.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: test.headers})
+			writer.WriteFrame(&PingFrame{Id: 1})
+			writer.WriteFrame(&SynStreamFrame{StreamId: 3, Headers: http.Header{"Url": []string{"/"}}})
+			if _, err := reader.ReadFrame(); err == nil {
+				t.Errorf("Version %d: read a header block over the limits", version)
+			} else if e, ok := err.(*Error); !ok || e.Err != test.err || e.StreamId != 1 {
+				t.Errorf("Version %d: expected %s, received %s", version, test.err, err)
+			}
+			/* The rest of the frame was skipped */
+			if frame, err := reader.ReadFrame(); err != nil {
+				t.Fatalf("Version %d: %s", version, err)
+			} else if ping, ok := frame.(*PingFrame); !ok || ping.Id != 1 {
+				t.Errorf("Version %d: expected PING, received %#v", version, frame)
+			}
+			/* The decompression context is lost */
+			if _, err := reader.ReadFrame(); err == nil {
+				t.Errorf("Version %d: read a header block after losing the decompression context", version)
+			} else if e, ok := err.(*Error); !ok || e.Err != test.err || e.StreamId != 3 {
+				t.Errorf("Version %d: expected %s, received %s", version, test.err, err)
+			}
+			if buffer.Len() != 0 {
+				t.Errorf("Version %d: %d bytes left unread", version, buffer.Len())
+			}
+		}
+	}
+}
+
+func TestFramePayloadLimit(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framer.MaxFramePayload = 10
+	if err := framer.WriteFrame(&DataFrame{StreamId: 1, Data: make([]byte, 11)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := framer.ReadFrame(); err == nil {
+		t.Errorf("Read a DATA frame larger than the limit")
+	} else if e, ok := err.(*Error); !ok || e.Err != PayloadTooLarge {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	/* SETTINGS claiming more entries than it carries */
+	buffer.Reset()
+	buffer.Write([]byte{0x80, Version, 0, 4, 0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff})
+	if _, err := framer.ReadFrame(); err == nil {
+		t.Errorf("Read a SETTINGS frame with a bogus count")
+	} else if e, ok := err.(*Error); !ok || e.Err != InvalidControlFrame {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestLongControlFrame(t *testing.T) {
+	for _, version := range []uint16{Version2, Version3} {
+		for _, frameType := range []ControlFrameType{TypeRstStream, TypeSettings, TypeNoop, TypePing, TypeGoAway, TypeWindowUpdate} {
+			buffer := new(bytes.Buffer)
+			framer, err := NewFramerVersion(buffer, buffer, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			/* A frame longer than its fields, followed by a PING */
+			buffer.Write([]byte{0x80, byte(version), 0, byte(frameType), 0, 0, 0, 16})
+			buffer.Write([]byte{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1})
+			framer.WriteFrame(&PingFrame{Id: 2})
+			if frame, err := framer.ReadFrame(); err != nil {
+				t.Errorf("Version %d: error reading a long frame of type %d: %s", version, frameType, err)
+			} else if reflect.TypeOf(frame) != reflect.TypeOf(cframeCtor[frameType]()) {
+				t.Errorf("Version %d: expected a frame of type %d, received %#v", version, frameType, frame)
+			}
+			/* The rest of the long frame was skipped */
+			if frame, err := framer.ReadFrame(); err != nil {
+				t.Fatalf("Version %d, type %d: %s", version, frameType, err)
+			} else if ping, ok := frame.(*PingFrame); !ok || ping.Id != 2 {
+				t.Errorf("Version %d, type %d: expected PING, received %#v", version, frameType, frame)
+			}
+		}
+	}
+}
+
+func TestShortControlFrame(t *testing.T) {
+	for _, version := range []uint16{Version2, Version3} {
+		for _, frameType := range []ControlFrameType{TypeSynStream, TypeSynReply, TypeHeaders, TypeRstStream, TypePing, TypeGoAway, TypeWindowUpdate} {
+			buffer := new(bytes.Buffer)
+			framer, err := NewFramerVersion(buffer, buffer, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			/* A frame too short for its fixed fields, followed by a PING */
+			buffer.Write([]byte{0x80, byte(version), 0, byte(frameType), 0, 0, 0, 2, 0, 1})
+			framer.WriteFrame(&PingFrame{Id: 1})
+			if frame, err := framer.ReadFrame(); err == nil {
+				t.Errorf("Version %d: read a short frame of type %d: %#v", version, frameType, frame)
+			} else if e, ok := err.(*Error); !ok || e.Err != InvalidControlFrame {
+				t.Errorf("Version %d: unexpected error for type %d: %s", version, frameType, err)
+			}
+			/* The short frame was skipped */
+			if frame, err := framer.ReadFrame(); err != nil {
+				t.Fatalf("Version %d: %s", version, err)
+			} else if ping, ok := frame.(*PingFrame); !ok || ping.Id != 1 {
+				t.Errorf("Version %d: expected PING, received %#v", version, frame)
+			}
+		}
+	}
+}
+
+func TestUnknownFrame(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* A control frame of type 0x42 with a 3-byte payload, followed by a PING */
+	buffer.Write([]byte{0x80, Version, 0, 0x42, 0, 0, 0, 3, 1, 2, 3})
+	ping := &PingFrame{Id: 1}
+	if err := framer.WriteFrame(ping); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, ok := frame.(*UnknownFrame)
+	if !ok || unknown.Type() != 0x42 || !bytes.Equal(unknown.Payload, []byte{1, 2, 3}) {
+		t.Fatalf("Unexpected frame: %#v", frame)
+	}
+	if frame, err := framer.ReadFrame(); err != nil || !reflect.DeepEqual(frame, ping) {
+		t.Errorf("The framer lost track of the stream: %#v, %v", frame, err)
+	}
+	/* Unknown frames can be written back as they were read */
+	if err := framer.WriteFrame(unknown); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), []byte{0x80, Version, 0, 0x42, 0, 0, 0, 3, 1, 2, 3}) {
+		t.Errorf("Unexpected bytes: %v", buffer.Bytes())
+	}
+	/* Sessions ignore them */
+	session := NewSession(nil, true)
+	if err := session.WriteFrame(unknown); err != nil {
+		t.Errorf("The session failed on an unknown frame: %s", err)
+	}
+	session.output.Close()
+	if frame, err := session.output.ReadFrame(); err != io.EOF {
+		t.Errorf("Unexpected frame: %#v", frame)
+	}
+}
+
+func TestSynStreamWrongVersion(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	writer, err := NewFramerVersion(buffer, buffer, Version3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewFramerVersion(buffer, buffer, Version2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{":method": {"GET"}}}); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(new(DummyHandler), true)
+	reply, err := SendExpect(session, frame, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst := reply.(*RstStreamFrame); rst.StreamId != 1 || rst.Status != UnsupportedVersion {
+		t.Errorf("A SYN_STREAM of the wrong version should be refused with UNSUPPORTED_VERSION, not %#v", rst)
+	}
+}
+
+func TestFramerLimitGoAway(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	framer, err := NewFramerVersion(conn, conn, Version3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framer.MaxFramePayload = 10
+	session := NewSession(echoHandler(t), true)
+	session.Version = Version3
+	session.transport = conn
+	go session.Serve(framer)
+	peerFramer, err := NewFramerVersion(peer, peer, Version3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go peerFramer.WriteFrame(&DataFrame{StreamId: 1, Data: make([]byte, 100)})
+	frame, err := ReadFrameTimeout(peerFramer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goAway, ok := frame.(*GoAwayFrame); !ok || goAway.Status != GoAwayProtocolError {
+		t.Errorf("Expected GOAWAY with PROTOCOL_ERROR, received %#v", frame)
+	}
+}
+
+func TestServerFramerLimits(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	srv := &Server{Handler: echoHandler(t), MaxFramePayload: 10}
+	go srv.serveConn(conn, nil)
+	peerFramer, err := NewFramer(peer, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go peerFramer.WriteFrame(&DataFrame{StreamId: 1, Data: make([]byte, 100)})
+	frame, err := ReadFrameTimeout(peerFramer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* Version 2 GOAWAY frames have no status */
+	if _, ok := frame.(*GoAwayFrame); !ok {
+		t.Errorf("Expected GOAWAY, received %#v", frame)
+	}
+}
+
+func TestServerMaxConcurrentStreams(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	srv := &Server{Handler: echoHandler(t), MaxConcurrentStreams: 1}
+	go srv.serveConn(conn, nil)
+	peerFramer, err := NewFramer(peer, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* The limit is advertised first */
+	frame, err := ReadFrameTimeout(peerFramer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings, ok := frame.(*SettingsFrame); !ok || len(settings.FlagIdValues) != 1 || settings.FlagIdValues[0].Id != SettingsMaxConcurrentStreams || settings.FlagIdValues[0].Value != 1 {
+		t.Fatalf("Expected SETTINGS with a limit of 1 stream, received %#v", frame)
+	}
+	/* Then enforced */
+	go func() {
+		peerFramer.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"Method": {"POST"}, "Url": {"/"}, "Version": {"HTTP/1.1"}}})
+		peerFramer.WriteFrame(&SynStreamFrame{StreamId: 3, Headers: http.Header{"Method": {"POST"}, "Url": {"/"}, "Version": {"HTTP/1.1"}}})
+	}()
+	for {
+		frame, err := ReadFrameTimeout(peerFramer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rst, ok := frame.(*RstStreamFrame); ok {
+			if rst.StreamId != 3 || rst.Status != RefusedStream {
+				t.Errorf("Excess stream should be refused, not %#v", rst)
+			}
+			return
+		}
+	}
+}
+
+func TestServerHeaderCompression(t *testing.T) {
+	conn, peer := net.Pipe()
+	srv := &Server{HeaderCompression: &HeaderCompression{Level: 42}}
+	if _, err := serveVersion(conn, nil, true, Version, 0, srv.setupSession); err == nil {
+		t.Errorf("Accepted an invalid compression level")
+	}
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Errorf("The connection was not closed")
+	}
+	/* zlib.NoCompression is 0, and must still be selectable */
+	for _, compression := range []*HeaderCompression{
+		&HeaderCompression{Level: zlib.BestSpeed},
+		&HeaderCompression{Level: zlib.NoCompression},
+		&HeaderCompression{Disabled: true},
+	} {
+		conn, peer := net.Pipe()
+		transport := &Transport{HeaderCompression: compression}
+		session, err := serveVersion(conn, nil, false, Version, 0, transport.setupSession)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerFramer, err := NewFramer(peer, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compression.Disabled {
+			peerFramer.DisableHeaderCompression()
+		}
+		url := strings.Repeat("/compression", 20)
+		stream, err := session.OpenStream(context.Background(), &http.Header{"Url": []string{url}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := ReadFrameTimeout(peerFramer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if syn, ok := frame.(*SynStreamFrame); !ok || syn.Headers.Get("Url") != url {
+			t.Errorf("%+v: Expected SYN_STREAM, received %#v", *compression, frame)
+		}
+		/* Stored zlib blocks are larger than their content, plain blocks are as large */
+		stats := peerFramer.HeaderStats()
+		switch {
+		case compression.Disabled:
+			if stats.CompressedIn != stats.RawIn {
+				t.Errorf("%+v: Header block compressed: %+v", *compression, stats)
+			}
+		case compression.Level == zlib.NoCompression:
+			if stats.CompressedIn <= stats.RawIn {
+				t.Errorf("%+v: Header block compressed: %+v", *compression, stats)
+			}
+		default:
+			if stats.CompressedIn >= stats.RawIn {
+				t.Errorf("%+v: Header block not compressed: %+v", *compression, stats)
+			}
+		}
+		stream.Close()
+		session.Close()
+		peer.Close()
+	}
+}
+
 func TestCreateParseSynStreamFrame(t *testing.T) {
 	buffer := new(bytes.Buffer)
 	framer := &Framer{
+		version:   Version,
 		headerCompressionDisabled: true,
 		w:         buffer,
 		headerBuf: new(bytes.Buffer),
@@ -118,9 +502,47 @@ func TestCreateParseSynStreamFrame(t *testing.T) {
 	}
 }
 
+func TestCreateParseSynStreamFrameV3(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramerVersion(buffer, buffer, Version3)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	synStreamFrame := SynStreamFrame{
+		CFHeader: ControlFrameHeader{
+			version:   Version3,
+			frameType: TypeSynStream,
+		},
+		StreamId:             3,
+		AssociatedToStreamId: 1,
+		Priority:             5,
+		Slot:                 2,
+		Headers: http.Header{
+			":path":    []string{"/"},
+			":method":  []string{"GET"},
+			":version": []string{"HTTP/1.1"},
+		},
+	}
+	if err := framer.WriteFrame(&synStreamFrame); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal("ReadFrame:", err)
+	}
+	parsedSynStreamFrame, ok := frame.(*SynStreamFrame)
+	if !ok {
+		t.Fatal("Parsed incorrect frame type:", frame)
+	}
+	if !reflect.DeepEqual(synStreamFrame, *parsedSynStreamFrame) {
+		t.Fatal("got: ", *parsedSynStreamFrame, "\nwant: ", synStreamFrame)
+	}
+}
+
 func TestCreateParseSynReplyFrame(t *testing.T) {
 	buffer := new(bytes.Buffer)
 	framer := &Framer{
+		version:   Version,
 		headerCompressionDisabled: true,
 		w:         buffer,
 		headerBuf: new(bytes.Buffer),
@@ -237,6 +659,63 @@ func TestCreateParseSettings(t *testing.T) {
 	}
 }
 
+func TestCreateParseV3Frames(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramerVersion(buffer, buffer, Version3)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	headers := http.Header{":status": []string{"200 OK"}, ":version": []string{"HTTP/1.1"}}
+	frames := []Frame{
+		&SynReplyFrame{CFHeader: ControlFrameHeader{version: Version3, frameType: TypeSynReply}, StreamId: 1, Headers: headers},
+		&HeadersFrame{CFHeader: ControlFrameHeader{version: Version3, frameType: TypeHeaders}, StreamId: 1, Headers: headers},
+		&RstStreamFrame{CFHeader: ControlFrameHeader{version: Version3, frameType: TypeRstStream}, StreamId: 1, Status: FrameTooLarge},
+		&GoAwayFrame{CFHeader: ControlFrameHeader{version: Version3, frameType: TypeGoAway}, LastGoodStreamId: 7, Status: GoAwayProtocolError},
+	}
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatalf("WriteFrame(%T): %s", frame, err)
+		}
+		parsed, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame(%T): %s", frame, err)
+		}
+		if !reflect.DeepEqual(frame, parsed) {
+			t.Fatal("got: ", parsed, "\nwant: ", frame)
+		}
+	}
+}
+
+func TestHeaderDictionaryV3(t *testing.T) {
+	// Dictionary id of the version 3 dictionary, as defined by the spec.
+	if id := adler32.Checksum([]byte(HeaderDictionaryV3)); id != 0xe3c6a7c2 {
+		t.Errorf("Wrong dictionary id for version 3: %#x", id)
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	writer, err := NewFramerVersion(buffer, buffer, Version3)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	reader, err := NewFramerVersion(buffer, buffer, Version2)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	if err := writer.WriteFrame(&PingFrame{Id: 1}); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	/* Frames of another version are skipped as unknown frames */
+	frame, err := reader.ReadFrame()
+	if unknown, ok := frame.(*UnknownFrame); err != nil || !ok || unknown.Version() != Version3 || unknown.Type() != TypePing {
+		t.Errorf("Reading a version 3 frame with a version 2 framer returned %#v, %#v", frame, err)
+	}
+	if _, err := NewFramerVersion(buffer, buffer, 4); err == nil {
+		t.Errorf("NewFramerVersion accepted an unsupported version")
+	}
+}
+
 func TestCreateParseNoop(t *testing.T) {
 	buffer := new(bytes.Buffer)
 	framer, err := NewFramer(buffer, buffer)
@@ -326,6 +805,7 @@ func TestCreateParseGoAway(t *testing.T) {
 func TestCreateParseHeadersFrame(t *testing.T) {
 	buffer := new(bytes.Buffer)
 	framer := &Framer{
+		version:   Version,
 		headerCompressionDisabled: true,
 		w:         buffer,
 		headerBuf: new(bytes.Buffer),
@@ -377,6 +857,37 @@ func TestCreateParseHeadersFrame(t *testing.T) {
 	}
 }
 
+func TestCreateParseWindowUpdate(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramerVersion(buffer, buffer, Version3)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	windowUpdateFrame := WindowUpdateFrame{
+		CFHeader: ControlFrameHeader{
+			version:   Version3,
+			frameType: TypeWindowUpdate,
+			length:    8,
+		},
+		StreamId:        1,
+		DeltaWindowSize: 4096,
+	}
+	if err := framer.WriteFrame(&windowUpdateFrame); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal("ReadFrame:", err)
+	}
+	parsedWindowUpdateFrame, ok := frame.(*WindowUpdateFrame)
+	if !ok {
+		t.Fatal("Parsed incorrect frame type:", frame)
+	}
+	if !reflect.DeepEqual(windowUpdateFrame, *parsedWindowUpdateFrame) {
+		t.Fatal("got: ", *parsedWindowUpdateFrame, "\nwant: ", windowUpdateFrame)
+	}
+}
+
 func TestCreateParseDataFrame(t *testing.T) {
 	buffer := new(bytes.Buffer)
 	framer, err := NewFramer(buffer, buffer)
@@ -424,7 +935,7 @@ func TestCompressionContextAcrossFrames(t *testing.T) {
 	if err := framer.WriteFrame(&headersFrame); err != nil {
 		t.Fatal("WriteFrame (HEADERS):", err)
 	}
-	synStreamFrame := SynStreamFrame{ControlFrameHeader{Version, TypeSynStream, 0, 0}, 2, 0, 0, nil}
+	synStreamFrame := SynStreamFrame{ControlFrameHeader{Version, TypeSynStream, 0, 0}, 2, 0, 0, 0, nil}
 	synStreamFrame.Headers = http.Header{
 		"Url":     []string{"http://www.google.com/"},
 		"Method":  []string{"get"},
@@ -499,10 +1010,11 @@ func TestMultipleSPDYFrames(t *testing.T) {
 	// Start the goroutines to write the frames.
 	go func() {
 		if err := writer.WriteFrame(&headersFrame); err != nil {
-			t.Fatal("WriteFrame (HEADERS): ", err)
+			t.Error("WriteFrame (HEADERS): ", err)
+			return
 		}
 		if err := writer.WriteFrame(&synStreamFrame); err != nil {
-			t.Fatal("WriteFrame (SYN_STREAM): ", err)
+			t.Error("WriteFrame (SYN_STREAM): ", err)
 		}
 	}()
 
@@ -892,7 +1404,7 @@ func TestBodyWrite(t *testing.T) {
 		t.Error("Writing to ResponseWriter body failed")
 	} else {
 		if !bytes.Equal(dataframe.Data, data) {
-			t.Error("ResponseWriter sent |%#v| instead of |%#v|", dataframe.Data, data)
+			t.Errorf("ResponseWriter sent |%#v| instead of |%#v|", dataframe.Data, data)
 		}
 	}
 }
@@ -908,7 +1420,7 @@ func TestBodyRead(t *testing.T) {
 			t.Error(err)
 		}
 		if n != len(data) {
-			t.Error("Request body received %d bytes instead of %d", n, len(data))
+			t.Errorf("Request body received %d bytes instead of %d", n, len(data))
 		}
 		locker.Unlock()
 	}), true)
@@ -932,14 +1444,14 @@ func TestBodyReadClose(t *testing.T) {
 			t.Error(err)
 		}
 		if n != len(data) {
-			t.Error("Request body received %d bytes instead of %d", n, len(data))
+			t.Errorf("Request body received %d bytes instead of %d", n, len(data))
 		}
 		n, err = r.Body.Read(result)
 		if err != io.EOF {
 			t.Error("Request body was not closed")
 		}
 		if n != 0 {
-			t.Error("Body.Read() should have returned 0, returned %d instead", n)
+			t.Errorf("Body.Read() should have returned 0, returned %d instead", n)
 		}
 		locker.Unlock()
 	}), true)
@@ -1125,3 +1637,2846 @@ func TestRstLoop(t *testing.T) {
 	}
 }
 
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func listenTLS(t *testing.T, handler http.Handler) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsListener := tls.NewListener(listener, withProtocols(testTLSConfig(t)))
+	go ListenAndServe(tlsListener, handler)
+	return tlsListener
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	listener := listenTLS(t, new(DummyHandler))
+	defer listener.Close()
+	for proto, version := range map[string][2]uint16{
+		ProtocolSPDY2:  {Version2, 0},
+		ProtocolSPDY3:  {Version3, 0},
+		ProtocolSPDY31: {Version3, 1},
+	} {
+		config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}}
+		session, err := DialTLSConfig(listener.Addr().String(), config, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", proto, err)
+		}
+		if session.Version != version[0] || session.MinorVersion != version[1] {
+			t.Errorf("%s: negotiated version %d.%d", proto, session.Version, session.MinorVersion)
+		}
+		session.Close()
+	}
+}
+
+func TestNegotiateNoSPDY(t *testing.T) {
+	listener := listenTLS(t, new(DummyHandler))
+	defer listener.Close()
+	config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ProtocolHTTP11}}
+	if _, err := DialTLSConfig(listener.Addr().String(), config, nil); err == nil {
+		t.Errorf("DialTLSConfig() should fail when no SPDY version is negotiated")
+	}
+}
+
+func TestRequestV3(t *testing.T) {
+	listener := listenTLS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/foo" || r.Host != "example.com" {
+			t.Errorf("Wrong request: %s %s (host %s)", r.Method, r.URL.Path, r.Host)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer listener.Close()
+	config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ProtocolSPDY3}}
+	session, err := DialTLSConfig(listener.Addr().String(), config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := http.Header{":method": {"POST"}, ":path": {"/foo"}, ":host": {"example.com"}, ":version": {"HTTP/1.1"}}
+	if err := stream.Syn(&headers, true); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrameTimeout(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, isReply := frame.(*SynReplyFrame); !isReply {
+		t.Errorf("Expected SYN_REPLY, received %#v", frame)
+	} else if status := reply.Headers.Get(":status"); status != "404 Not Found" {
+		t.Errorf("Wrong status: '%s'", status)
+	}
+}
+
+func TestFallbackHTTP(t *testing.T) {
+	listener := listenTLS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.Proto))
+	}))
+	defer listener.Close()
+	for _, protos := range [][]string{nil, {ProtocolHTTP11}} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: protos},
+		}}
+		resp, err := client.Get("https://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("%v: %s", protos, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello HTTP/1.1" {
+			t.Errorf("%v: HTTP/1.1 fallback returned '%s'", protos, body)
+		}
+	}
+}
+
+func newSessionV3(handler http.Handler, server bool) *Session {
+	session := NewSession(handler, server)
+	session.Version = Version3
+	return session
+}
+
+/* Read frames from `src` until `n` bytes of DATA were received */
+func readData(t *testing.T, src Reader, n int) {
+	for total := 0; total < n; {
+		frame, err := ReadFrameTimeout(src)
+		if err != nil || frame == nil {
+			t.Fatalf("Received %d bytes out of %d (%v)", total, n, err)
+		}
+		if data, isData := frame.(*DataFrame); isData {
+			total += len(data.Data)
+		}
+	}
+}
+
+func TestFlowControlSend(t *testing.T) {
+	session := newSessionV3(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, DefaultInitialWindowSize + 1000)
+	done := Promise(func() error { return stream.WriteDataFrame(data, true) })
+	readData(t, session, DefaultInitialWindowSize)
+	select {
+		case <-done:			t.Fatalf("Sent %d bytes with a window of %d", len(data), DefaultInitialWindowSize)
+		case <-time.After(100 * time.Millisecond):
+	}
+	session.WriteFrame(&WindowUpdateFrame{StreamId: stream.Id, DeltaWindowSize: 1000})
+	readData(t, session, 1000)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlowControlViolation(t *testing.T) {
+	session := newSessionV3(new(DummyHandler), true)
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, DefaultInitialWindowSize + 1)
+	frame, err := SendExpect(session, &DataFrame{StreamId: 1, Data: data}, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := frame.(*RstStreamFrame).Status; status != FlowControlError {
+		t.Errorf("Exceeding the window should be a flow control error, not %d", status)
+	}
+}
+
+func TestFlowControlReceive(t *testing.T) {
+	session := newSessionV3(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}), true)
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, DefaultInitialWindowSize / 2)
+	frame, err := SendExpect(session, &DataFrame{StreamId: 1, Data: data}, reflect.TypeOf(&WindowUpdateFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta := frame.(*WindowUpdateFrame).DeltaWindowSize; delta != uint32(len(data)) {
+		t.Errorf("Consuming %d bytes opened the window by %d", len(data), delta)
+	}
+}
+
+func newSessionV31(handler http.Handler, server bool) *Session {
+	session := newSessionV3(handler, server)
+	session.MinorVersion = 1
+	return session
+}
+
+func TestSessionFlowControlSend(t *testing.T) {
+	session := newSessionV31(new(DummyHandler), false)
+	var streams [2]*Stream
+	for i := range streams {
+		stream, err := session.InitiateStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Syn(nil, false); err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = stream
+	}
+	data := make([]byte, DefaultInitialWindowSize)
+	if err := <-Promise(func() error { return streams[0].WriteDataFrame(data, true) }); err != nil {
+		t.Fatal(err)
+	}
+	readData(t, session, len(data))
+	/* The second stream has a full window of its own, but the session window is exhausted */
+	done := Promise(func() error { return streams[1].WriteDataFrame(data[:1000], true) })
+	select {
+		case <-done:			t.Fatalf("Sent data with an exhausted session window")
+		case <-time.After(100 * time.Millisecond):
+	}
+	session.WriteFrame(&WindowUpdateFrame{StreamId: 0, DeltaWindowSize: 1000})
+	readData(t, session, 1000)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSessionFlowControlViolation(t *testing.T) {
+	session := newSessionV31(new(DummyHandler), true)
+	session.initialRecvWindow = 2 * DefaultInitialWindowSize
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, DefaultInitialWindowSize + 1)
+	if err := session.WriteFrame(&DataFrame{StreamId: 1, Data: data}); err == nil {
+		t.Fatal("Exceeding the session window should fail the session")
+	}
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goAway, ok := frame.(*GoAwayFrame); !ok {
+		t.Errorf("Expected GOAWAY, received %#v", frame)
+	} else if goAway.Status != GoAwayProtocolError {
+		t.Errorf("Exceeding the session window should be a protocol error, not %d", goAway.Status)
+	}
+}
+
+func TestZeroWindowUpdate(t *testing.T) {
+	session := newSessionV31(new(DummyHandler), true)
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := SendExpect(session, &WindowUpdateFrame{StreamId: 1}, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := frame.(*RstStreamFrame).Status; status != ProtocolError {
+		t.Errorf("A delta of 0 should be a protocol error, not %d", status)
+	}
+	if err := session.WriteFrame(&WindowUpdateFrame{StreamId: 0}); err == nil {
+		t.Fatal("A session delta of 0 should fail the session")
+	}
+	frame, err = ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goAway, ok := frame.(*GoAwayFrame); !ok || goAway.Status != GoAwayProtocolError {
+		t.Errorf("Expected GOAWAY with a protocol error, received %#v", frame)
+	}
+}
+
+func TestSessionWindowSize(t *testing.T) {
+	session := newSessionV31(new(DummyHandler), true)
+	session.SessionWindowSize = 1 << 20
+	if err := session.start(); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, ok := frame.(*WindowUpdateFrame)
+	if !ok || update.StreamId != 0 {
+		t.Fatalf("Expected a session WINDOW_UPDATE, received %#v", frame)
+	}
+	if update.DeltaWindowSize != 1 << 20 - DefaultInitialWindowSize {
+		t.Errorf("Growing the session window to %d sent a delta of %d", 1 << 20, update.DeltaWindowSize)
+	}
+	/* The larger window is enforced */
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WriteFrame(&DataFrame{StreamId: 1, Data: make([]byte, DefaultInitialWindowSize)}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettingsInitialWindowSize(t *testing.T) {
+	session := newSessionV3(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	settings := &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{0, SettingsInitialWindowSize, 1000}}}
+	if err := session.WriteFrame(settings); err != nil {
+		t.Fatal(err)
+	}
+	if received := session.Settings(); !reflect.DeepEqual(received, settings.FlagIdValues) {
+		t.Errorf("Received %#v, stored %#v", settings.FlagIdValues, received)
+	}
+	done := Promise(func() error { return stream.WriteDataFrame(make([]byte, 2000), true) })
+	readData(t, session, 1000)
+	select {
+		case <-done:			t.Fatalf("Sent 2000 bytes with a window of 1000")
+		case <-time.After(100 * time.Millisecond):
+	}
+	session.WriteFrame(&WindowUpdateFrame{StreamId: stream.Id, DeltaWindowSize: 1000})
+	readData(t, session, 1000)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettingsInitialWindowSizeBeforeSyn(t *testing.T) {
+	session := newSessionV3(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{0, SettingsInitialWindowSize, 1000}}}
+	if err := session.WriteFrame(settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	done := Promise(func() error { return stream.WriteDataFrame(make([]byte, 2000), true) })
+	readData(t, session, 1000)
+	select {
+		case <-done:			t.Fatalf("Sent 2000 bytes with a window of 1000")
+		case <-time.After(100 * time.Millisecond):
+	}
+	stream.Close()
+}
+
+func TestSendSettingsInitialWindowSizeBeforeSyn(t *testing.T) {
+	session := newSessionV3(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.SendSettings(SettingsFlagIdValue{0, SettingsInitialWindowSize, 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	/* Skip the SETTINGS and SYN_STREAM frames */
+	for i := 0; i < 2; i++ {
+		if _, err := ReadFrameTimeout(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session.WriteFrame(&SynReplyFrame{StreamId: stream.Id})
+	frame, err := SendExpect(session, &DataFrame{StreamId: stream.Id, Data: make([]byte, 2000)}, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := frame.(*RstStreamFrame).Status; status != FlowControlError {
+		t.Errorf("Exceeding the window should be a flow control error, not %d", status)
+	}
+}
+
+func TestSettingsMaxConcurrentStreams(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{0, SettingsMaxConcurrentStreams, 1}}})
+	if _, err := session.InitiateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.InitiateStream(); err == nil {
+		t.Errorf("Opened 2 streams with a limit of 1")
+	} else if e, ok := err.(*Error); !ok || e.Err != TooManyStreams {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestPersistedSettings(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{FlagSettingsPersistValue, SettingsRoundTripTime, 100},
+		{0, SettingsMaxConcurrentStreams, 10},
+	}})
+	expected := []SettingsFlagIdValue{{FlagSettingsPersisted, SettingsRoundTripTime, 100}}
+	if persisted := session.PersistedSettings(); !reflect.DeepEqual(persisted, expected) {
+		t.Errorf("Persisted %#v instead of %#v", persisted, expected)
+	}
+	session.WriteFrame(&SettingsFrame{CFHeader: ControlFrameHeader{Flags: ControlFlagSettingsClearSettings}})
+	if persisted := session.PersistedSettings(); len(persisted) != 0 {
+		t.Errorf("Clearing settings left %#v", persisted)
+	}
+}
+
+func TestReplaySettings(t *testing.T) {
+	persisted := []SettingsFlagIdValue{{FlagSettingsPersistValue, SettingsRoundTripTime, 100}}
+	session := NewSession(new(DummyHandler), false)
+	if err := session.ReplaySettings(persisted); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SettingsFlagIdValue{{FlagSettingsPersisted, SettingsRoundTripTime, 100}}
+	if sent, ok := frame.(*SettingsFrame); !ok || !reflect.DeepEqual(sent.FlagIdValues, expected) {
+		t.Errorf("Expected SETTINGS %#v, sent %#v", expected, frame)
+	}
+	if replayed := session.PersistedSettings(); !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("Replayed %#v, persisted %#v", expected, replayed)
+	}
+	if local := session.LocalSettings(); len(local) != 0 {
+		t.Errorf("Replayed settings were stored as ours: %#v", local)
+	}
+}
+
+func TestSendSettings(t *testing.T) {
+	session := NewSession(new(DummyHandler), true)
+	settings := []SettingsFlagIdValue{{FlagSettingsPersistValue, SettingsMaxConcurrentStreams, 100}}
+	if err := session.SendSettings(settings...); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent, ok := frame.(*SettingsFrame); !ok || !reflect.DeepEqual(sent.FlagIdValues, settings) {
+		t.Errorf("Expected SETTINGS %#v, sent %#v", settings, frame)
+	}
+	if local := session.LocalSettings(); !reflect.DeepEqual(local, settings) {
+		t.Errorf("Sent %#v, stored %#v", settings, local)
+	}
+	if err := session.SendSettings(SettingsFlagIdValue{0, SettingsInitialWindowSize, MaxWindowSize + 1}); err == nil {
+		t.Errorf("Sent an initial window size larger than %d", MaxWindowSize)
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	session := NewSession(new(DummyHandler), true)
+	session.MaxConcurrentStreams = 1
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := SendExpect(session, &SynStreamFrame{StreamId: 3}, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst := frame.(*RstStreamFrame); rst.StreamId != 3 || rst.Status != RefusedStream {
+		t.Errorf("Excess stream should be refused, not %#v", rst)
+	}
+	if n := session.NStreams(); n != 1 {
+		t.Errorf("%d streams open with a limit of 1", n)
+	}
+	session.CloseStream(1)
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if n := session.NStreams(); n != 1 {
+		t.Errorf("Stream was not accepted after a slot freed up (%d streams open)", n)
+	}
+}
+
+func TestSendSettingsMaxConcurrentStreams(t *testing.T) {
+	session := NewSession(new(DummyHandler), true)
+	if err := session.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	/* The advertised limit is enforced */
+	if err := session.SendSettings(SettingsFlagIdValue{0, SettingsMaxConcurrentStreams, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFrameTimeout(session); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := SendExpect(session, &SynStreamFrame{StreamId: 3}, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst := frame.(*RstStreamFrame); rst.StreamId != 3 || rst.Status != RefusedStream {
+		t.Errorf("Excess stream should be refused, not %#v", rst)
+	}
+	if n := session.NStreams(); n != 1 {
+		t.Errorf("%d streams open with an advertised limit of 1", n)
+	}
+}
+
+func TestWaitForStreams(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	session.WaitForStreams = true
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{0, SettingsMaxConcurrentStreams, 1}}})
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := Promise(func() error {
+		_, err := session.InitiateStream()
+		return err
+	})
+	select {
+		case <-done:			t.Fatalf("Opened 2 streams with a limit of 1")
+		case <-time.After(100 * time.Millisecond):
+	}
+	session.CloseStream(stream.Id)
+	select {
+		case err := <-done:		if err != nil { t.Error(err) }
+		case <-time.After(time.Second):	t.Errorf("InitiateStream still blocked after a stream was closed")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := Promise(func() error { return session.Shutdown(ctx) })
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goAway, ok := frame.(*GoAwayFrame); !ok || goAway.Status != GoAwayOK {
+		t.Fatalf("Expected GOAWAY, received %#v", frame)
+	}
+	/* New streams are ignored */
+	if _, err := SendExpect(session, &SynStreamFrame{StreamId: 2}, nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := session.InitiateStream(); err == nil {
+		t.Errorf("Initiated a stream after GOAWAY")
+	}
+	select {
+		case <-done:			t.Fatalf("Shutdown returned with a stream still open")
+		case <-time.After(100 * time.Millisecond):
+	}
+	/* The stream completes once FIN was sent both ways */
+	fin := ControlFrameHeader{Flags: ControlFlagFin}
+	if err := stream.WriteFrame(&SynStreamFrame{StreamId: stream.Id, CFHeader: fin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WriteFrame(&SynReplyFrame{StreamId: stream.Id, CFHeader: fin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if !session.Closed() {
+		t.Errorf("Session still open after Shutdown")
+	}
+}
+
+func TestShutdownAfterRequest(t *testing.T) {
+	session := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}), true)
+	syn := &SynStreamFrame{StreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}}
+	syn.Headers = http.Header{"Method": {"GET"}, "Url": {"/"}, "Version": {"HTTP/1.1"}}
+	if err := session.WriteFrame(syn); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		frame, err := ReadFrameTimeout(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.GetFinFlag() {
+			break
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := session.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed after the only request completed: %v", err)
+	}
+	if n := session.NStreams(); n != 0 {
+		t.Errorf("%d streams still open after Shutdown", n)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	if _, err := session.InitiateStream(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	if err := session.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown should time out, not return %v", err)
+	}
+	if n := session.NStreams(); n != 0 {
+		t.Errorf("%d streams still open after Shutdown", n)
+	}
+}
+
+func TestShutdownTransport(t *testing.T) {
+	local, remote := net.Pipe()
+	session, err := Serve(local, new(DummyHandler), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framer, err := NewFramer(remote, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := Promise(func() error { return session.Shutdown(context.Background()) })
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := frame.(*GoAwayFrame); !ok {
+		t.Errorf("Expected GOAWAY, received %#v", frame)
+	}
+	if frame, err := framer.ReadFrame(); err == nil {
+		t.Errorf("Transport still open after GOAWAY (received %#v)", frame)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReceiveGoAway(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	var streams [2]*Stream
+	for i := range streams {
+		stream, err := session.InitiateStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = stream
+	}
+	if err := session.WriteFrame(&GoAwayFrame{LastGoodStreamId: streams[0].Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := streams[1].ReadFrame(); err == nil {
+		t.Errorf("Stream %d is still open after GOAWAY", streams[1].Id)
+	} else if e, ok := err.(*Error); !ok || e.Err != StreamNotProcessed {
+		t.Errorf("Unprocessed stream should be retryable, not fail with %v", err)
+	}
+	if n := session.NStreams(); n != 1 {
+		t.Errorf("%d streams open after GOAWAY instead of 1", n)
+	}
+	if _, err := session.InitiateStream(); err == nil {
+		t.Errorf("Initiated a stream after receiving GOAWAY")
+	} else if e, ok := err.(*Error); !ok || e.Err != SessionGoingAway {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("done"))
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := Promise(func() error { return srv.Serve(listener) })
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	framer, err := NewFramer(conn, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn := &SynStreamFrame{StreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}}
+	syn.Headers = http.Header{"Method": {"GET"}, "Url": {"/"}, "Version": {"HTTP/1.1"}}
+	if err := framer.WriteFrame(syn); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+	defer cancel()
+	done := Promise(func() error { return srv.Shutdown(ctx) })
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goAway, ok := frame.(*GoAwayFrame); !ok || goAway.LastGoodStreamId != 1 {
+		t.Errorf("Expected GOAWAY for stream 1, received %#v", frame)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve should return ErrServerClosed, not %v", err)
+	}
+	/* The open stream is allowed to complete */
+	close(release)
+	var body []byte
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			break
+		}
+		if data, ok := frame.(*DataFrame); ok {
+			body = append(body, data.Data...)
+		}
+	}
+	if string(body) != "done" {
+		t.Errorf("Received '%s' instead of 'done'", body)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv := &Server{Handler: new(DummyHandler)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := Promise(func() error { return srv.Serve(listener) })
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	framer, err := NewFramer(conn, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* Make sure the session is up before closing */
+	if err := framer.WriteFrame(&PingFrame{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := framer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve should return ErrServerClosed, not %v", err)
+	}
+	if frame, err := framer.ReadFrame(); err == nil {
+		t.Errorf("Connection still open after Close (received %#v)", frame)
+	}
+}
+
+func TestListenAndServeTCPError(t *testing.T) {
+	if err := ListenAndServeTCP("invalid address", new(DummyHandler)); err == nil {
+		t.Errorf("Listening on an invalid address should fail")
+	}
+}
+
+func echoHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("X-Echo", r.Header.Get("X-Echo"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.RequestURI(), r.Host, body)
+	})
+}
+
+func testRoundTrip(t *testing.T, client *http.Client, url, host string) {
+	req, err := http.NewRequest("POST", url + "/foo?bar=1", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Echo", "echo")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Status != "201 Created" {
+		t.Errorf("Wrong status: %d '%s'", resp.StatusCode, resp.Status)
+	}
+	if echo := resp.Header.Get("X-Echo"); echo != "echo" {
+		t.Errorf("Wrong header: '%s'", echo)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "POST /foo?bar=1 " + host + " hello"; string(body) != expected {
+		t.Errorf("Received '%s' instead of '%s'", body, expected)
+	}
+}
+
+func TestTransportTLS(t *testing.T) {
+	listener := listenTLS(t, echoHandler(t))
+	defer listener.Close()
+	client := &http.Client{Transport: NewTransport(&tls.Config{InsecureSkipVerify: true})}
+	testRoundTrip(t, client, "https://" + listener.Addr().String(), listener.Addr().String())
+}
+
+func TestTransportTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go ListenAndServe(listener, echoHandler(t))
+	client := &http.Client{Transport: NewTransport(nil)}
+	testRoundTrip(t, client, "http://" + listener.Addr().String(), listener.Addr().String())
+}
+
+func TestClientSessionWithoutHandler(t *testing.T) {
+	session := NewSession(nil, false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.WriteFrame(&SynStreamFrame{StreamId: stream.Id}); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := frame.(*SynStreamFrame); !ok {
+		t.Errorf("Expected SYN_STREAM, received %#v", frame)
+	}
+}
+
+func TestSessionPool(t *testing.T) {
+	var pool sessionPool
+	dials := 0
+	dial := func(ctx context.Context) (*Session, error) {
+		dials++
+		return NewSession(new(DummyHandler), false), nil
+	}
+	get := func(expectedDials int) *Session {
+		session, err := pool.get(context.Background(), "http://example.com:80", dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dials != expectedDials {
+			t.Fatalf("Dialed %d sessions instead of %d", dials, expectedDials)
+		}
+		return session
+	}
+	session := get(1)
+	if get(1) != session {
+		t.Errorf("Live session was not reused")
+	}
+	/* The session reached the server's limit */
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{0, SettingsMaxConcurrentStreams, 1}}})
+	if _, err := session.InitiateStream(); err != nil {
+		t.Fatal(err)
+	}
+	session = get(2)
+	/* The session received GOAWAY */
+	session.WriteFrame(&GoAwayFrame{})
+	session = get(3)
+	/* The session was closed */
+	session.Close()
+	get(4)
+}
+
+func TestSessionPoolSharedDial(t *testing.T) {
+	var pool sessionPool
+	started, release := make(chan bool), make(chan bool)
+	dial := func(ctx context.Context) (*Session, error) {
+		close(started)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return NewSession(new(DummyHandler), false), nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := pool.get(ctx, "http://example.com:80", dial)
+		first <- err
+	}()
+	<-started
+	second := make(chan error, 1)
+	go func() {
+		_, err := pool.get(context.Background(), "http://example.com:80", dial)
+		second <- err
+	}()
+	for waiters := 0; waiters != 2; time.Sleep(time.Millisecond) {
+		pool.lock.Lock()
+		waiters = pool.dialing["http://example.com:80"].waiters
+		pool.lock.Unlock()
+	}
+	/* The first caller gives up: the others keep waiting for the dial */
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("The cancelled caller received %v", err)
+	}
+	select {
+		case err := <-second:	t.Fatalf("The other caller stopped waiting: %v", err)
+		case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+		case err := <-second:	if err != nil { t.Error(err) }
+		case <-time.After(time.Second):	t.Fatalf("The other caller received no session")
+	}
+}
+
+func TestSessionPoolAbandonedDial(t *testing.T) {
+	var pool sessionPool
+	dials := make(chan context.Context, 2)
+	dial := func(ctx context.Context) (*Session, error) {
+		dials <- ctx
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if _, err := pool.get(ctx, "http://example.com:80", dial); err != context.DeadlineExceeded {
+		t.Errorf("Waiting for the dial should fail with %v, not %v", context.DeadlineExceeded, err)
+	}
+	/* Nobody waits for the dial anymore: it is cancelled */
+	select {
+		case <-(<-dials).Done():
+		case <-time.After(time.Second):	t.Fatalf("The abandoned dial was not cancelled")
+	}
+	/* The next caller dials again, instead of waiting for the abandoned dial */
+	ctx, cancel = context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	pool.get(ctx, "http://example.com:80", dial)
+	select {
+		case <-dials:
+		default:	t.Errorf("The next caller didn't dial")
+	}
+}
+
+func TestSessionPoolReplayFailure(t *testing.T) {
+	pool := sessionPool{persisted: map[string][]SettingsFlagIdValue{
+		"http://example.com:80": {{0, SettingsMaxConcurrentStreams, 10}},
+	}}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	dial := func(ctx context.Context) (*Session, error) {
+		/* The session closes before the settings are replayed */
+		session := NewSession(new(DummyHandler), false)
+		session.transport = conn
+		session.Close()
+		return session, nil
+	}
+	if _, err := pool.get(context.Background(), "http://example.com:80", dial); err == nil {
+		t.Fatalf("Replaying settings on a closed session should fail")
+	}
+	if n := len(pool.sessions["http://example.com:80"]); n != 0 {
+		t.Errorf("Pooled %d sessions which failed to replay settings", n)
+	}
+	/* Its connection is closed */
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("The connection should be closed, not %v", err)
+	}
+}
+
+func TestTransportDialTimeout(t *testing.T) {
+	/* The server accepts connections, but never completes the TLS handshake */
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	transport := NewTransport(&tls.Config{InsecureSkipVerify: true})
+	transport.DialTimeout = 50 * time.Millisecond
+	req, _ := http.NewRequest("GET", "https://" + listener.Addr().String() + "/", nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := transport.RoundTrip(req)
+		done <- err
+	}()
+	select {
+		case err := <-done:	if err == nil { t.Errorf("The request succeeded without a TLS handshake") }
+		case <-time.After(time.Second):	t.Fatalf("The dial didn't time out")
+	}
+}
+
+func TestSessionPoolPersistedSettings(t *testing.T) {
+	var pool sessionPool
+	dial := func(ctx context.Context) (*Session, error) {
+		return NewSession(new(DummyHandler), false), nil
+	}
+	session, err := pool.get(context.Background(), "http://example.com:80", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{FlagSettingsPersistValue, SettingsRoundTripTime, 100}}})
+	session.WriteFrame(&GoAwayFrame{})
+	session, err = pool.get(context.Background(), "http://example.com:80", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SettingsFlagIdValue{{FlagSettingsPersisted, SettingsRoundTripTime, 100}}
+	if replayed, ok := frame.(*SettingsFrame); !ok || !reflect.DeepEqual(replayed.FlagIdValues, expected) {
+		t.Errorf("Expected SETTINGS %#v, sent %#v", expected, frame)
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	accepted	chan bool
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted <- true
+	}
+	return conn, err
+}
+
+func TestTransportReuse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: listener, accepted: make(chan bool, 10)}
+	defer listener.Close()
+	go ListenAndServe(counting, echoHandler(t))
+	client := &http.Client{Transport: NewTransport(nil)}
+	for i := 0; i < 3; i++ {
+		testRoundTrip(t, client, "http://" + listener.Addr().String(), listener.Addr().String())
+	}
+	if n := len(counting.accepted); n != 1 {
+		t.Errorf("Opened %d connections for 3 requests", n)
+	}
+	client.CloseIdleConnections()
+}
+
+func TestTransportMaxConcurrentStreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		echoHandler(t).ServeHTTP(w, r)
+	})
+	srv := &Server{Handler: slow, MaxConcurrentStreams: 4}
+	go srv.Serve(listener)
+	defer srv.Close()
+	client := &http.Client{Transport: NewTransport(nil)}
+	defer client.CloseIdleConnections()
+	url := "http://" + listener.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	/* More requests than the server takes at once: they wait for a stream, even those with a body */
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("hello %d", i)
+			req, err := http.NewRequestWithContext(ctx, "POST", url + "/", strings.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Errorf("Request %d failed: %s", i, err)
+				return
+			}
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("Request %d: %s", i, err)
+			} else if expected := "POST / " + listener.Addr().String() + " " + body; string(data) != expected {
+				t.Errorf("Request %d: received '%s' instead of '%s'", i, data, expected)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestWaitForRoom(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	refuse := func() *Error {
+		stream, err := session.InitiateStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.CloseStream(stream.Id)
+		return &Error{StreamNotProcessed, stream.Id}
+	}
+	/* Without other streams nor a limit, the peer didn't refuse the stream for lack of room */
+	refused := refuse()
+	if err := session.waitForRoom(ctx, refused); err != refused {
+		t.Errorf("Waiting for room should fail with %v, not %v", refused, err)
+	}
+	/* The stream was refused before the limit was known: it can be sent again */
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{0, SettingsMaxConcurrentStreams, 1}}})
+	if err := session.waitForRoom(ctx, refused); err != nil {
+		t.Errorf("Waiting for room failed: %v", err)
+	}
+	refused = refuse()
+	if err := session.waitForRoom(ctx, refused); err != refused {
+		t.Errorf("Waiting for room should fail with %v, not %v", refused, err)
+	}
+	/* Otherwise, wait for another stream to close */
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused = &Error{StreamNotProcessed, stream.Id + 2}
+	done := Promise(func() error { return session.waitForRoom(ctx, refused) })
+	select {
+		case err := <-done:			t.Fatalf("Stopped waiting for room with stream %d open: %v", stream.Id, err)
+		case <-time.After(50 * time.Millisecond):
+	}
+	session.CloseStream(stream.Id)
+	if err := <-done; err != nil {
+		t.Errorf("Waiting for room failed: %v", err)
+	}
+}
+
+func pushHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/style.css" {
+			w.Write([]byte("css"))
+			return
+		}
+		pusher, ok := w.(http.Pusher)
+		if !ok {
+			t.Fatalf("ResponseWriter does not implement http.Pusher")
+		}
+		if err := pusher.Push("/style.css", nil); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("index"))
+	})
+}
+
+func testPush(t *testing.T, transport *Transport, url string) {
+	pushed := make(chan string, 1)
+	transport.PushHandler = func(req *http.Request, resp *http.Response) {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		pushed <- fmt.Sprintf("%s %d %s", req.URL.Path, resp.StatusCode, body)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "index" {
+		t.Errorf("Received '%s' instead of 'index'", body)
+	}
+	select {
+		case push := <-pushed:		if push != "/style.css 200 css" { t.Errorf("Wrong push: '%s'", push) }
+		case <-time.After(time.Second):	t.Errorf("Nothing was pushed")
+	}
+}
+
+func TestPushV3(t *testing.T) {
+	listener := listenTLS(t, pushHandler(t))
+	defer listener.Close()
+	testPush(t, NewTransport(&tls.Config{InsecureSkipVerify: true}), "https://" + listener.Addr().String())
+}
+
+func TestPushV2(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go ListenAndServe(listener, pushHandler(t))
+	testPush(t, NewTransport(nil), "http://" + listener.Addr().String())
+}
+
+func TestSetPushHandler(t *testing.T) {
+	server := NewSession(pushHandler(t), true)
+	client := NewSession(nil, false)
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	pushed := make(chan string, 1)
+	/* The session is already served */
+	client.SetPushHandler(func(req *http.Request, resp *http.Response) {
+		defer resp.Body.Close()
+		pushed <- req.URL.Path
+	})
+	req, err := http.NewRequest("GET", "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	select {
+		case path := <-pushed:		if path != "/style.css" { t.Errorf("Wrong push: '%s'", path) }
+		case <-time.After(time.Second):	t.Errorf("Nothing was pushed")
+	}
+}
+
+func TestPushInvalidAssociation(t *testing.T) {
+	client := NewSession(new(DummyHandler), false)
+	server := NewSession(new(DummyHandler), true)
+	for _, test := range []struct {
+		session	*Session
+		syn	*SynStreamFrame
+	}{
+		/* No such stream */
+		{client, &SynStreamFrame{StreamId: 2, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}}},
+		/* Clients can't push */
+		{server, &SynStreamFrame{StreamId: 3, AssociatedToStreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}}},
+	} {
+		frame, err := SendExpect(test.session, test.syn, reflect.TypeOf(&RstStreamFrame{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rst := frame.(*RstStreamFrame); rst.Status != InvalidStream || rst.StreamId != test.syn.StreamId {
+			t.Errorf("Invalid push should be reset with INVALID_STREAM, not %#v", rst)
+		}
+	}
+}
+
+func TestRefusePush(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFrameTimeout(session); err != nil {
+		t.Fatal(err)
+	}
+	push := &SynStreamFrame{StreamId: 2, AssociatedToStreamId: stream.Id, CFHeader: ControlFrameHeader{Flags: ControlFlagUnidirectional}}
+	frame, err := SendExpect(session, push, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst := frame.(*RstStreamFrame); rst.Status != Cancel || rst.StreamId != 2 {
+		t.Errorf("Pushes should be cancelled without a PushHandler, not reset with %#v", rst)
+	}
+}
+
+func TestUnidirectionalStream(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateUnidirectionalStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if syn, ok := frame.(*SynStreamFrame); !ok || syn.CFHeader.Flags&ControlFlagUnidirectional == 0 {
+		t.Fatalf("Expected a unidirectional SYN_STREAM, not %#v", frame)
+	}
+	/* The peer can't reply */
+	frame, err = SendExpect(session, &SynReplyFrame{StreamId: stream.Id}, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst := frame.(*RstStreamFrame); rst.Status != ProtocolError || rst.StreamId != stream.Id {
+		t.Errorf("A reply to a unidirectional stream should be reset with PROTOCOL_ERROR, not %#v", rst)
+	}
+	if _, err := stream.ReadFrame(); err == nil {
+		t.Errorf("Reading a reset unidirectional stream should fail")
+	}
+	if session.NStreams() != 0 {
+		t.Errorf("The reset stream is still registered")
+	}
+}
+
+func TestReceiveUnidirectionalStream(t *testing.T) {
+	received := make(chan *Stream, 1)
+	session := NewSession(nil, true)
+	session.handler = HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- w.(*ResponseWriter).Stream
+	}))
+	session.WriteFrame(&SynStreamFrame{
+		StreamId:	1,
+		Headers:	http.Header{"method": {"GET"}, "url": {"/"}, "version": {"HTTP/1.1"}},
+		CFHeader:	ControlFrameHeader{Flags: ControlFlagUnidirectional},
+	})
+	select {
+		case stream := <-received: {
+			if err := stream.Reply(nil, false); err == nil {
+				t.Errorf("Replied to a unidirectional stream")
+			} else if e, ok := err.(*Error); !ok || e.Err != IllegalUnidirectional {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			if err := stream.WriteDataFrame([]byte("hello"), true); err == nil {
+				t.Errorf("Sent data on a unidirectional stream")
+			}
+		}
+		case <-time.After(time.Second): t.Fatal("The unidirectional stream was not served")
+	}
+}
+
+func expectFrames(t *testing.T, r Reader, expected ...Frame) {
+	for _, e := range expected {
+		frame, err := ReadFrameTimeout(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame != e {
+			t.Fatalf("Expected %#v, received %#v", e, frame)
+		}
+	}
+}
+
+func TestWriteSchedulerPriority(t *testing.T) {
+	scheduler := newWriteScheduler()
+	low, high := &SynStreamFrame{StreamId: 1, Priority: 7}, &SynStreamFrame{StreamId: 3, Priority: 0}
+	lowData := []Frame{&DataFrame{StreamId: 1}, &DataFrame{StreamId: 1}}
+	highData := []Frame{&SynReplyFrame{StreamId: 3}, &DataFrame{StreamId: 3}}
+	settings := &SettingsFrame{}
+	for _, frame := range []Frame{low, high, lowData[0], lowData[1], highData[0], highData[1], settings} {
+		if err := scheduler.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* Control frames first, then the high priority stream */
+	expectFrames(t, scheduler, low, high, settings, highData[0], highData[1], lowData[0], lowData[1])
+}
+
+func TestWriteSchedulerRoundRobin(t *testing.T) {
+	scheduler := newWriteScheduler()
+	a := []Frame{&DataFrame{StreamId: 1}, &DataFrame{StreamId: 1}, &DataFrame{StreamId: 1}}
+	b := []Frame{&DataFrame{StreamId: 3}, &DataFrame{StreamId: 3}}
+	for _, frame := range append(a, b...) {
+		scheduler.WriteFrame(frame)
+	}
+	expectFrames(t, scheduler, a[0], b[0], a[1], b[1], a[2])
+}
+
+func TestWriteSchedulerRst(t *testing.T) {
+	scheduler := newWriteScheduler()
+	data, rst := &DataFrame{StreamId: 1}, &RstStreamFrame{StreamId: 1, Status: Cancel}
+	other := &DataFrame{StreamId: 3}
+	scheduler.WriteFrame(data)
+	scheduler.WriteFrame(other)
+	scheduler.WriteFrame(rst)
+	/* The frames of the reset stream are discarded */
+	expectFrames(t, scheduler, rst, other)
+}
+
+func TestWriteSchedulerBlocking(t *testing.T) {
+	scheduler := newWriteScheduler()
+	for i := 0; i < maxQueuedFrames; i++ {
+		scheduler.WriteFrame(&DataFrame{StreamId: 1})
+	}
+	done := Promise(func() error { return scheduler.WriteFrame(&DataFrame{StreamId: 1}) })
+	/* Other streams and control frames don't block */
+	if err := scheduler.WriteFrame(&DataFrame{StreamId: 3}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+		case <-done:			t.Fatalf("Queued more than %d frames", maxQueuedFrames)
+		case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := scheduler.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	scheduler.Close()
+	if err := scheduler.WriteFrame(&PingFrame{}); err == nil {
+		t.Errorf("Wrote to a closed scheduler")
+	}
+	/* Queued frames are still sent */
+	for i := 0; i < maxQueuedFrames + 1; i++ {
+		if _, err := scheduler.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := scheduler.ReadFrame(); err != io.EOF {
+		t.Errorf("Expected EOF, not %v", err)
+	}
+}
+
+func TestWriteSchedulerControlBlocking(t *testing.T) {
+	scheduler := newWriteScheduler()
+	for i := 0; i < maxQueuedControlFrames; i++ {
+		if err := scheduler.WriteFrame(&PingFrame{Id: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := Promise(func() error { return scheduler.WriteFrame(&PingFrame{}) })
+	select {
+		case <-done:			t.Fatalf("Queued more than %d control frames", maxQueuedControlFrames)
+		case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := scheduler.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	/* Writers waiting for room fail once the scheduler is closed */
+	done = Promise(func() error { return scheduler.WriteFrame(&PingFrame{}) })
+	scheduler.Close()
+	if err := <-done; err == nil {
+		t.Errorf("Wrote to a closed scheduler")
+	}
+}
+
+func TestWriteSchedulerControlContext(t *testing.T) {
+	scheduler := newWriteScheduler()
+	for i := 0; i < maxQueuedControlFrames; i++ {
+		if err := scheduler.WriteFrame(&PingFrame{Id: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	done := Promise(func() error { return scheduler.writeFrame(ctx, &PingFrame{}) })
+	select {
+		case err := <-done: {
+			if err != context.DeadlineExceeded {
+				t.Errorf("Waiting for room should fail with %v, not %v", context.DeadlineExceeded, err)
+			}
+		}
+		case <-time.After(time.Second):	t.Fatalf("Waiting for room ignored the context")
+	}
+}
+
+/* Against a peer which doesn't read, Shutdown returns by its deadline, and doesn't block other calls */
+func TestShutdownStalledPeer(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	for i := 0; i < maxQueuedControlFrames; i++ {
+		if err := session.output.WriteFrame(&PingFrame{Id: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opened := Promise(func() error {
+		_, err := session.OpenStream(context.Background(), nil)
+		return err
+	})
+	/* OpenStream waits for room without holding the session lock */
+	time.Sleep(10 * time.Millisecond)
+	counted := Promise(func() error { session.NStreams(); return nil })
+	select {
+		case <-counted:
+		case <-time.After(time.Second):	t.Fatalf("NStreams blocked while a SYN_STREAM waited for room")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	shutdown := Promise(func() error { return session.Shutdown(ctx) })
+	select {
+		case err := <-shutdown: {
+			if err != context.DeadlineExceeded {
+				t.Errorf("Shutdown should time out, not return %v", err)
+			}
+		}
+		case <-time.After(time.Second):	t.Fatalf("Shutdown blocked past its deadline")
+	}
+	/* The session is closed: the stream waiting to send SYN_STREAM gives up */
+	select {
+		case err := <-opened: {
+			if err == nil {
+				t.Errorf("Opened a stream on a closed session")
+			}
+		}
+		case <-time.After(time.Second):	t.Fatalf("OpenStream blocked after the session was closed")
+	}
+}
+
+func TestSessionPriority(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	bulk, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulk.Priority = 3
+	bulk.Syn(nil, false)
+	for i := 0; i < maxQueuedFrames; i++ {
+		bulk.WriteDataFrame([]byte("bulk"), false)
+	}
+	interactive, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	interactive.Syn(nil, false)
+	interactive.WriteDataFrame([]byte("interactive"), true)
+	/* Let the streams queue their frames */
+	time.Sleep(100 * time.Millisecond)
+	var frames []Frame
+	for i := 0; i < 3; i++ {
+		frame, err := ReadFrameTimeout(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	/* Both SYN_STREAM frames jump the queue, then the interactive stream goes first */
+	if data, ok := frames[2].(*DataFrame); !ok || data.StreamId != interactive.Id {
+		t.Errorf("Frames were sent in this order: %#v", frames)
+	}
+}
+
+/* Open, reset and close many streams concurrently. Run with -race. */
+func TestConcurrentStreams(t *testing.T) {
+	server := NewSession(echoHandler(t), true)
+	client := NewSession(nil, false)
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 20; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				client.NStreams()
+				switch (worker + i) % 3 {
+					/* Reset a stream right after opening it */
+					case 0: {
+						stream, err := client.InitiateStream()
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						stream.Syn(&http.Header{"method": {"GET"}, "url": {"/"}, "version": {"HTTP/1.1"}}, false)
+						stream.Rst(Cancel)
+					}
+					/* Complete a request */
+					case 1: {
+						req, _ := http.NewRequest("POST", "https://example.com/", strings.NewReader("hello"))
+						resp, err := client.RoundTrip(req)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "POST / example.com hello" {
+							t.Errorf("Received '%s' (%v)", body, err)
+						}
+						resp.Body.Close()
+					}
+					/* Close the response before reading it */
+					case 2: {
+						req, _ := http.NewRequest("GET", "https://example.com/", nil)
+						resp, err := client.RoundTrip(req)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						resp.Body.Close()
+					}
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	/* All streams are eventually de-registered */
+	for deadline := time.Now().Add(time.Second); client.NStreams() + server.NStreams() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d client and %d server streams are still open", client.NStreams(), server.NStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/* Send a body of `n` DATA frames */
+func chunkedHandler(n int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), 1024)
+		for i := 0; i < n; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestCloseBodyEarly(t *testing.T) {
+	server := NewSession(chunkedHandler(64), true)
+	client := NewSession(nil, false)
+	spliced := Promise(func() error { return Splice(client, server, false) })
+	defer server.Close()
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	for i := 0; i < 200; i++ {
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com/", nil)
+		resp, err := client.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Request %d: %s", i, err)
+		}
+		resp.Body.Read(make([]byte, 1))
+		/* The server keeps sending DATA frames after we reset the stream */
+		resp.Body.Close()
+	}
+	select {
+		case err := <-spliced:	t.Fatalf("The session ended: %v", err)
+		default:
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com/", nil)
+	resp, err := client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := ioutil.ReadAll(resp.Body); err != nil || len(body) != 64 * 1024 {
+		t.Errorf("Received %d bytes (%v) instead of %d", len(body), err, 64 * 1024)
+	}
+}
+
+/* Stream ids never change: a stream which would send SYN_STREAM out of order can't be opened */
+func TestSynOutOfOrder(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	first, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Id != 1 || second.Id != 3 {
+		t.Errorf("Streams were initiated with ids %d and %d instead of 1 and 3", first.Id, second.Id)
+	}
+	done := Promise(func() error { return second.Syn(nil, false) })
+	select {
+		case err := <-done:		if err != nil { t.Fatal(err) }
+		case <-time.After(time.Second):	t.Fatalf("The second stream can't be opened before the first one")
+	}
+	if err := first.Syn(nil, false); err == nil {
+		t.Errorf("Sent SYN_STREAM for stream 1 after stream 3")
+	} else if e, ok := err.(*Error); !ok || e.Err != InvalidStreamId {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if first.Id != 1 || second.Id != 3 {
+		t.Errorf("Stream ids changed to %d and %d", first.Id, second.Id)
+	}
+	if frame, err := ReadFrameTimeout(session); err != nil {
+		t.Fatal(err)
+	} else if syn, ok := frame.(*SynStreamFrame); !ok || syn.StreamId != 3 {
+		t.Errorf("Sent %#v instead of the SYN_STREAM of stream 3", frame)
+	}
+	/* The stream which can't be opened is de-registered, and sends nothing */
+	if frame, _ := ReadFrameTimeout(session); frame != nil {
+		t.Errorf("Sent %#v for a stream which never sent SYN_STREAM", frame)
+	}
+	if n := session.NStreams(); n != 1 {
+		t.Errorf("%d streams are open instead of 1", n)
+	}
+	/* A stream closed before SYN_STREAM sends nothing */
+	unopened, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unopened.Rst(Cancel)
+	for deadline := time.Now().Add(time.Second); session.NStreams() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams are open instead of 1", session.NStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if frame, _ := ReadFrameTimeout(session); frame != nil {
+		t.Errorf("Sent %#v for a stream which never sent SYN_STREAM", frame)
+	}
+}
+
+/* Concurrent OpenStream calls get their ids in the order their SYN_STREAM frames are sent */
+func TestOpenStreamConcurrent(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	ids := make(chan uint32, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := session.OpenStream(context.Background(), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- stream.Id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	opened := make(map[uint32]bool)
+	for id := range ids {
+		opened[id] = true
+	}
+	var last uint32
+	for range opened {
+		frame, err := ReadFrameTimeout(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syn, ok := frame.(*SynStreamFrame)
+		if !ok || syn.StreamId <= last || !opened[syn.StreamId] {
+			t.Fatalf("Sent %#v after the SYN_STREAM of stream %d", frame, last)
+		}
+		last = syn.StreamId
+	}
+}
+
+func TestSynAfterGoAway(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	stream, err := session.InitiateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WriteFrame(&GoAwayFrame{LastGoodStreamId: stream.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Syn(nil, false); err == nil {
+		t.Errorf("Sent SYN_STREAM after receiving GOAWAY")
+	} else if e, ok := err.(*Error); !ok || e.Err != StreamNotProcessed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestOpenStreamCancel(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := session.OpenStream(ctx, &http.Header{"method": {"GET"}, "url": {"/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFrameTimeout(session); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst, ok := frame.(*RstStreamFrame); !ok || rst.Status != Cancel || rst.StreamId != stream.Id {
+		t.Errorf("Cancelling the context should reset the stream with CANCEL, not send %#v", frame)
+	}
+	if _, err := stream.ReadFrame(); err != context.Canceled {
+		t.Errorf("Reading a cancelled stream should fail with %v, not %v", context.Canceled, err)
+	}
+	select {
+		case <-stream.Context().Done():
+		case <-time.After(time.Second): t.Errorf("The context of a reset stream should be done")
+	}
+}
+
+func TestOpenStreamCancelAfterFin(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := session.OpenStream(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.WriteDataFrame(nil, true)
+	ReadFrameTimeout(session)
+	ReadFrameTimeout(session)
+	/* Our side of the stream is closed, but it can still be reset */
+	cancel()
+	frame, err := ReadFrameTimeout(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst, ok := frame.(*RstStreamFrame); !ok || rst.Status != Cancel {
+		t.Errorf("Cancelling the context should reset the stream with CANCEL, not send %#v", frame)
+	}
+	if session.NStreams() != 0 {
+		t.Errorf("The reset stream is still registered")
+	}
+}
+
+func TestOpenStreamWaitContext(t *testing.T) {
+	session := NewSession(new(DummyHandler), false)
+	session.WaitForStreams = true
+	session.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{0, SettingsMaxConcurrentStreams, 1}}})
+	if _, err := session.OpenStream(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if _, err := session.OpenStream(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("Waiting for a stream should fail with %v, not %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	contexts := make(chan *http.Request, 2)
+	server := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contexts <- r
+	}), true)
+	server.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"Method": {"GET"}, "Url": {"/reset"}, "Version": {"HTTP/1.1"}}})
+	server.WriteFrame(&SynStreamFrame{StreamId: 3, Headers: http.Header{"Method": {"GET"}, "Url": {"/close"}, "Version": {"HTTP/1.1"}}})
+	requests := make(map[string]context.Context)
+	for i := 0; i < 2; i++ {
+		r := <-contexts
+		requests[r.URL.Path] = r.Context()
+	}
+	/* The peer resets the first stream, then the session ends */
+	server.WriteFrame(&RstStreamFrame{StreamId: 1, Status: Cancel})
+	for _, path := range []string{"/reset", "/close"} {
+		if path == "/close" {
+			server.Close()
+		}
+		select {
+			case <-requests[path].Done():
+			case <-time.After(time.Second): t.Errorf("The context of %s should be cancelled", path)
+		}
+	}
+}
+
+func TestCancelOneStream(t *testing.T) {
+	server := NewSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sibling" {
+			chunkedHandler(64).ServeHTTP(w, r)
+			return
+		}
+		/* Keep sending until the stream is reset */
+		for r.Context().Err() == nil {
+			if _, err := w.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}), true)
+	client := NewSession(nil, false)
+	spliced := Promise(func() error { return Splice(client, server, false) })
+	defer server.Close()
+	defer client.Close()
+	timeout, stop := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer stop()
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithCancel(timeout)
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com/cancelled", nil)
+		cancelled, err := client.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Request %d: %s", i, err)
+		}
+		/* Let the unread body fill the stream, until the session waits for room to pass the next frame */
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		/* Only the cancelled stream is reset: its sibling on the same session still works */
+		req, _ = http.NewRequestWithContext(timeout, "GET", "https://example.com/sibling", nil)
+		sibling, err := client.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Request %d: %s", i, err)
+		}
+		if body, err := ioutil.ReadAll(sibling.Body); err != nil || len(body) != 64 * 1024 {
+			t.Fatalf("Request %d: received %d bytes (%v) instead of %d", i, len(body), err, 64 * 1024)
+		}
+		sibling.Body.Close()
+		cancelled.Body.Close()
+	}
+	select {
+		case err := <-spliced:	t.Fatalf("The session ended: %v", err)
+		default:
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, listener.Addr().String(), nil, nil); err == nil {
+		t.Errorf("Dialed with a cancelled context")
+	}
+}
+
+func TestTransportCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	cancelled := make(chan bool)
+	go ListenAndServe(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://" + listener.Addr().String() + "/", nil)
+	resp, err := NewTransport(nil).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := ioutil.ReadAll(resp.Body); err != context.Canceled {
+		t.Errorf("Reading the body of a cancelled request should fail with %v, not %v", context.Canceled, err)
+	}
+	select {
+		case <-cancelled:
+		case <-time.After(time.Second): t.Errorf("The server should see the request cancelled")
+	}
+}
+
+func TestConn(t *testing.T) {
+	server := NewSession(nil, true)
+	server.AcceptStreams = true
+	client := NewSession(nil, false)
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		conn, headers, err := server.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if headers.Get("Tunnel") != "echo" {
+			t.Errorf("Unexpected headers: %#v", headers)
+		}
+		io.Copy(conn, conn)
+		conn.CloseWrite()
+	}()
+	conn, err := client.Open(http.Header{"Tunnel": {"echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ net.Conn = conn
+	message := strings.Repeat("hello world ", 1000)
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Read failed: %s", err)
+	} else if string(data) != message {
+		t.Errorf("Received %d bytes instead of %d", len(data), len(message))
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != net.ErrClosed {
+		t.Errorf("Read on a closed Conn should fail with %v, not %v", net.ErrClosed, err)
+	}
+}
+
+func TestConnCloseStalledPeer(t *testing.T) {
+	/* Nobody reads the frames of the session */
+	session := NewSession(nil, false)
+	defer session.Close()
+	conn, err := session.Open(http.Header{"Tunnel": {"echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* More frames than the session queues for a stream, and FIN */
+	for i := 0; i < 10 * maxQueuedFrames; i++ {
+		if _, err := conn.Write([]byte{'x'}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	closed := Promise(func() error { return conn.Close() })
+	select {
+		case err := <-closed:	if err != nil { t.Fatal(err) }
+		case <-time.After(time.Second):	t.Fatalf("Close blocked on the frames before FIN")
+	}
+	/* Nothing is sent after RST_STREAM */
+	reset := false
+	for {
+		frame, err := ReadFrameTimeout(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame == nil {
+			break
+		}
+		if _, isRst := frame.(*RstStreamFrame); isRst {
+			reset = true
+		} else if reset {
+			t.Fatalf("Sent %#v after RST_STREAM", frame)
+		}
+	}
+	if !reset {
+		t.Errorf("The stream was not reset")
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	server := NewSession(nil, true)
+	server.AcceptStreams = true
+	client := NewSession(nil, false)
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := server.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	conn, err := client.Open(http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Errorf("Read should time out, not fail with %v", err)
+	}
+	/* Clearing the deadline makes the Conn usable again */
+	conn.SetReadDeadline(time.Time{})
+	peer := <-accepted
+	peer.Write([]byte("x"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Read failed: %s", err)
+	}
+	/* Closing before FIN resets the stream */
+	peer.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Read on a reset stream should fail")
+	} else if e, ok := err.(*Error); !ok || e.Err != StreamReset {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestConnWriteDeadline(t *testing.T) {
+	server := NewSession(nil, true)
+	server.AcceptStreams = true
+	client := NewSession(nil, false)
+	server.Version, client.Version = Version3, Version3
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	go server.Accept()
+	conn, err := client.Open(http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* The peer doesn't read, so the write blocks once the window is full */
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := conn.Write(make([]byte, 2 * DefaultInitialWindowSize))
+	if err != os.ErrDeadlineExceeded {
+		t.Errorf("Write should time out, not fail with %v", err)
+	}
+	if n != DefaultInitialWindowSize {
+		t.Errorf("Write returned %d bytes instead of the %d bytes sent", n, DefaultInitialWindowSize)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Errorf("Write on a reset stream should fail")
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	server := NewSession(nil, true)
+	server.AcceptStreams = true
+	client := NewSession(nil, false)
+	spliced := Promise(func() error { return Splice(client, server, false) })
+	defer server.Close()
+	defer client.Close()
+	conns := make([]*Conn, acceptBacklog + 10)
+	for i := range conns {
+		conn, err := client.Open(http.Header{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	/* The streams beyond the backlog are refused */
+	for _, conn := range conns[acceptBacklog:] {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("Read on a refused stream should fail")
+		} else if e, ok := err.(*Error); !ok || e.Err != StreamReset {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	/* The session still accepts and opens streams */
+	for range conns[:acceptBacklog] {
+		if _, _, err := server.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := client.Open(http.Header{"Tunnel": {"echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, headers, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get("Tunnel") != "echo" {
+		t.Errorf("Unexpected headers: %#v", headers)
+	}
+	peer.Write([]byte("x"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Read failed: %s", err)
+	}
+	select {
+		case err := <-spliced:	t.Fatalf("The session ended: %v", err)
+		default:
+	}
+}
+
+func TestRefuseStreamsWithoutAccept(t *testing.T) {
+	/* Eg. the client sessions of a Transport */
+	session := NewSession(nil, false)
+	frame, err := SendExpect(session, &SynStreamFrame{StreamId: 2}, reflect.TypeOf(&RstStreamFrame{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst := frame.(*RstStreamFrame); rst.StreamId != 2 || rst.Status != RefusedStream {
+		t.Errorf("Streams should be refused until Accept is called, not reset with %#v", rst)
+	}
+	if n := session.NStreams(); n != 0 {
+		t.Errorf("%d streams are left open", n)
+	}
+	/* Nothing is left to wait for */
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := session.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+}
+
+func TestAcceptClosed(t *testing.T) {
+	session := NewSession(nil, true)
+	session.Close()
+	if _, _, err := session.Accept(); err != io.EOF {
+		t.Errorf("Accept on a closed session should fail with %v, not %v", io.EOF, err)
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	server := NewStreamSession(StreamHandlerFunc(func(stream *Stream) {
+		frame, err := stream.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, ok := frame.(*SynStreamFrame); !ok {
+			t.Errorf("The first frame should be SYN_STREAM, not %#v", frame)
+		}
+		stream.Reply(&http.Header{"Command": {frame.GetHeaders().Get("Command")}}, false)
+		for {
+			frame, err := stream.ReadFrame()
+			if err != nil {
+				return
+			}
+			if data, ok := frame.(*DataFrame); ok {
+				stream.WriteDataFrame(data.Data, data.GetFinFlag())
+			}
+		}
+	}), true)
+	client := NewSession(nil, false)
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	stream, err := client.OpenStream(context.Background(), &http.Header{"Command": {"echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.WriteDataFrame([]byte("hello"), true)
+	frame, err := stream.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, ok := frame.(*SynReplyFrame); !ok || reply.Headers.Get("Command") != "echo" {
+		t.Errorf("Unexpected reply: %#v", frame)
+	}
+	frame, err = stream.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := frame.(*DataFrame); !ok || string(data.Data) != "hello" || !data.GetFinFlag() {
+		t.Errorf("Unexpected frame: %#v", frame)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := NewSession(nil, true)
+	client := NewSession(nil, false)
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	for _, session := range []*Session{client, server, client} {
+		if _, err := session.Ping(context.Background()); err != nil {
+			t.Errorf("Ping failed: %s", err)
+		}
+	}
+	if client.lastPingId != 3 || server.lastPingId != 2 {
+		t.Errorf("Unexpected ping ids: %d and %d", client.lastPingId, server.lastPingId)
+	}
+}
+
+func TestPingEcho(t *testing.T) {
+	session := NewSession(nil, false)
+	/* The server's pings are echoed, replies to unknown pings of ours are not */
+	ping := &PingFrame{Id: 2}
+	session.WriteFrame(&PingFrame{Id: 3})
+	session.WriteFrame(ping)
+	session.output.Close()
+	expectFrames(t, session.output, ping)
+	if frame, err := session.output.ReadFrame(); err != io.EOF {
+		t.Errorf("Unexpected frame: %#v", frame)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	/* The peer never replies */
+	go io.Copy(ioutil.Discard, peer)
+	framer, err := NewFramer(conn, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(nil, false)
+	session.transport = conn
+	session.KeepAliveInterval = 10 * time.Millisecond
+	session.KeepAliveTimeout = 20 * time.Millisecond
+	done := make(chan bool)
+	go func() {
+		session.Serve(framer)
+		close(done)
+	}()
+	select {
+		case <-done:
+		case <-time.After(time.Second): t.Errorf("The session should be closed when pings are not answered")
+	}
+	if !session.Closed() {
+		t.Errorf("The session is not closed")
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	stream, peer := NewStream(1, false)
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := stream.ReadFrame(); err != os.ErrDeadlineExceeded {
+		t.Errorf("ReadFrame should time out, not fail with %v", err)
+	}
+	/* No frame is lost, and clearing the deadline makes the stream usable again */
+	stream.SetReadDeadline(time.Time{})
+	syn := &SynStreamFrame{StreamId: 1}
+	if err := peer.WriteFrame(syn); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := stream.ReadFrame(); err != nil || frame != syn {
+		t.Errorf("Unexpected frame: %#v (%v)", frame, err)
+	}
+	stream.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := stream.ReadFrame(); err != os.ErrDeadlineExceeded {
+		t.Errorf("A deadline in the past should make ReadFrame fail, not %v", err)
+	}
+}
+
+func TestStreamWriteDeadline(t *testing.T) {
+	release := make(chan bool)
+	reset := make(chan StatusCode, 1)
+	server := NewStreamSession(StreamHandlerFunc(func(stream *Stream) {
+		<-release
+		for {
+			frame, err := stream.ReadFrame()
+			if err != nil {
+				reset <- 0
+				return
+			}
+			if rst, ok := frame.(*RstStreamFrame); ok {
+				reset <- rst.Status
+				return
+			}
+		}
+	}), true)
+	server.Version = Version3
+	client := newSessionV3(nil, false)
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	stream, err := client.OpenStream(context.Background(), &http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* The handler doesn't read, so the write blocks once the window is full */
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := stream.WriteDataFrame(make([]byte, 2 * DefaultInitialWindowSize), false); err != os.ErrDeadlineExceeded {
+		t.Errorf("The write should time out, not fail with %v", err)
+	}
+	if err := stream.WriteDataFrame([]byte("hello"), false); err != os.ErrDeadlineExceeded {
+		t.Errorf("Writes after the deadline should fail, not with %v", err)
+	}
+	close(release)
+	select {
+		case status := <-reset: {
+			if status != Cancel {
+				t.Errorf("The stream should be reset with Cancel, not %v", status)
+			}
+		}
+		case <-time.After(time.Second): t.Errorf("The stream was not reset")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server := NewSession(echoHandler(t), true)
+	server.IdleTimeout = 50 * time.Millisecond
+	client := NewSession(nil, false)
+	go Splice(client, server, true)
+	defer client.Close()
+	if err := server.start(); err != nil {
+		t.Fatal(err)
+	}
+	/* An open stream keeps the session alive */
+	stream, err := client.OpenStream(context.Background(), &http.Header{"Method": {"GET"}, "Url": {"/"}, "Version": {"HTTP/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if server.Closed() {
+		t.Fatalf("The session was closed with an open stream")
+	}
+	stream.Rst(Cancel)
+	for deadline := time.Now().Add(time.Second); !server.Closed(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The idle session was not closed")
+		}
+	}
+	/* GOAWAY reaches the client after the server is closed */
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		client.lock.Lock()
+		peerGoingAway := client.peerGoingAway
+		client.lock.Unlock()
+		if peerGoingAway {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The client should have received GOAWAY")
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	/* The peer never speaks */
+	go io.Copy(ioutil.Discard, peer)
+	framer, err := NewFramer(conn, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(echoHandler(t), true)
+	session.transport = conn
+	session.HandshakeTimeout = 20 * time.Millisecond
+	done := make(chan bool)
+	go func() {
+		session.Serve(framer)
+		close(done)
+	}()
+	select {
+		case <-done:
+		case <-time.After(time.Second): t.Errorf("The session should be closed when the peer doesn't speak")
+	}
+}
+
+/* An extension frame carrying a string */
+type metadataPayload struct {
+	value string
+}
+
+func (p *metadataPayload) ReadPayload(version uint16, payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("empty metadata")
+	}
+	p.value = string(payload)
+	return nil
+}
+
+func (p *metadataPayload) WritePayload(version uint16) ([]byte, error) {
+	return []byte(p.value), nil
+}
+
+const typeMetadata ControlFrameType = 0xf001
+
+var registerMetadata sync.Once
+
+func registerMetadataFrame(t *testing.T) {
+	registerMetadata.Do(func() {
+		if err := RegisterControlFrame(typeMetadata, func() ExtensionPayload { return new(metadataPayload) }); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestExtensionFrame(t *testing.T) {
+	registerMetadataFrame(t)
+	if err := RegisterControlFrame(typeMetadata, func() ExtensionPayload { return new(metadataPayload) }); err == nil {
+		t.Errorf("Registered a type twice")
+	}
+	if err := RegisterControlFrame(TypePing, func() ExtensionPayload { return new(metadataPayload) }); err == nil {
+		t.Errorf("Registered a type defined by the protocol")
+	}
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := framer.WriteFrame(NewExtensionFrame(typeMetadata, 0, &metadataPayload{"hello"})); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext, ok := frame.(*ExtensionFrame); !ok || ext.Type() != typeMetadata || ext.Payload.(*metadataPayload).value != "hello" {
+		t.Errorf("Unexpected frame: %#v", frame)
+	}
+	/* A payload which can't be decoded makes an UnknownFrame, and the next frame can be read */
+	framer.WriteFrame(NewExtensionFrame(typeMetadata, 0, &metadataPayload{}))
+	framer.WriteFrame(&PingFrame{Id: 1})
+	frame, err = framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown, ok := frame.(*UnknownFrame); !ok || unknown.Type() != typeMetadata || unknown.Err == nil {
+		t.Errorf("Expected an UnknownFrame with an error, received %#v", frame)
+	}
+	if frame, err := framer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := frame.(*PingFrame); !ok {
+		t.Errorf("Expected PING, received %#v", frame)
+	}
+	/* The payload limit of the Framer applies to extension frames too */
+	framer.MaxFramePayload = 4
+	if err := framer.WriteFrame(NewExtensionFrame(typeMetadata, 0, &metadataPayload{"hello"})); err == nil {
+		t.Errorf("Wrote an extension frame larger than the limit")
+	} else if e, ok := err.(*Error); !ok || e.Err != PayloadTooLarge {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestSessionExtensionFrame(t *testing.T) {
+	registerMetadataFrame(t)
+	received := make(chan string, 1)
+	server := NewSession(nil, true)
+	client := NewSession(nil, false)
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	server.SetExtensionHandler(func(frame *ExtensionFrame) {
+		received <- frame.Payload.(*metadataPayload).value
+	})
+	if err := client.SendExtensionFrame(NewExtensionFrame(typeMetadata, 0, &metadataPayload{"hello"})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+		case value := <-received: {
+			if value != "hello" {
+				t.Errorf("Received %q", value)
+			}
+		}
+		case <-time.After(time.Second): t.Errorf("The extension frame was not dispatched")
+	}
+}
+
+func TestSessionInvalidExtensionFrame(t *testing.T) {
+	registerMetadataFrame(t)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	framer, err := NewFramer(conn, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(nil, true)
+	session.SetExtensionHandler(func(frame *ExtensionFrame) {
+		t.Errorf("Dispatched an invalid extension frame: %#v", frame)
+	})
+	go session.Serve(framer)
+	defer session.Close()
+	peerFramer, err := NewFramer(peer, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		peerFramer.WriteFrame(NewExtensionFrame(typeMetadata, 0, &metadataPayload{}))
+		peerFramer.WriteFrame(&PingFrame{Id: 1})
+	}()
+	/* The session goes on */
+	frame, err := ReadFrameTimeout(peerFramer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping, ok := frame.(*PingFrame); !ok || ping.Id != 1 {
+		t.Errorf("Expected the PING reply, received %#v", frame)
+	}
+}
+
+/* A Writer which counts the compressed DATA frames going through it */
+type compressionTap struct {
+	dst		Writer
+	lock		sync.Mutex
+	compressed	int
+	setFlag		bool	// Set DataFlagCompressed on every DATA frame
+}
+
+func (tap *compressionTap) WriteFrame(frame Frame) error {
+	if data, ok := frame.(*DataFrame); ok && tap.setFlag {
+		frame = &DataFrame{StreamId: data.StreamId, Flags: data.Flags | DataFlagCompressed, Data: data.Data}
+	}
+	if data, ok := frame.(*DataFrame); ok && data.Flags&DataFlagCompressed != 0 {
+		tap.lock.Lock()
+		tap.compressed += 1
+		tap.lock.Unlock()
+	}
+	return tap.dst.WriteFrame(frame)
+}
+
+/* Serve each stream by replying with the data it received, uncompressed */
+func collectHandler(t *testing.T) StreamHandler {
+	return StreamHandlerFunc(func(stream *Stream) {
+		if _, err := stream.ReadFrame(); err != nil {
+			return
+		}
+		stream.Reply(nil, false)
+		var body []byte
+		for {
+			frame, err := stream.ReadFrame()
+			if err != nil {
+				stream.Rst(ProtocolError)
+				return
+			}
+			if data, ok := frame.(*DataFrame); ok {
+				if data.Flags&DataFlagCompressed != 0 {
+					t.Errorf("The handler received a compressed frame")
+				}
+				body = append(body, data.Data...)
+			}
+			if frame.GetFinFlag() {
+				break
+			}
+		}
+		stream.WriteDataFrame(body, true)
+	})
+}
+
+func TestCompressedData(t *testing.T) {
+	for _, version := range []uint16{Version2, Version3} {
+		server := NewStreamSession(collectHandler(t), true)
+		server.Version = version
+		client := NewSession(nil, false)
+		client.Version = version
+		client.CompressData = true
+		tap := &compressionTap{dst: server}
+		go Copy(tap, client)
+		go Copy(client, server)
+		body := bytes.Repeat([]byte("hello world "), 20000)
+		stream, err := client.OpenStream(context.Background(), &http.Header{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.WriteDataFrame(body, true); err != nil {
+			t.Fatal(err)
+		}
+		var received []byte
+		for {
+			frame, err := ReadFrameTimeout(stream)
+			if err != nil {
+				t.Fatalf("Version %d: %s", version, err)
+			}
+			if data, ok := frame.(*DataFrame); ok {
+				received = append(received, data.Data...)
+			}
+			if frame.GetFinFlag() {
+				break
+			}
+		}
+		if !bytes.Equal(received, body) {
+			t.Errorf("Version %d: received %d bytes instead of %d", version, len(received), len(body))
+		}
+		/* DataFlagCompressed only exists in version 2 */
+		tap.lock.Lock()
+		if version == Version2 && tap.compressed == 0 {
+			t.Errorf("Version %d: no compressed frame was sent", version)
+		}
+		if version >= Version3 && tap.compressed != 0 {
+			t.Errorf("Version %d: %d compressed frames were sent", version, tap.compressed)
+		}
+		tap.lock.Unlock()
+		client.Close()
+		server.Close()
+	}
+}
+
+/* The DATA frames of a stream share one zlib stream, sync-flushed after each frame */
+func TestCompressedDataContext(t *testing.T) {
+	messages := [][]byte{
+		bytes.Repeat([]byte("hello world "), 100),
+		bytes.Repeat([]byte("hello world "), 100),
+		[]byte("goodbye"),
+		bytes.Repeat([]byte("hello world "), 5000),
+	}
+	/* Inflate frames from a peer which keeps one zlib stream */
+	stream, _ := NewStream(1, false)
+	var buffer bytes.Buffer
+	compressor := zlib.NewWriter(&buffer)
+	for i, message := range messages {
+		buffer.Reset()
+		compressor.Write(message)
+		compressor.Flush()
+		inflated, err := stream.inflate(append([]byte(nil), buffer.Bytes()...))
+		if err != nil {
+			t.Fatalf("Frame %d: %s", i, err)
+		}
+		if !bytes.Equal(inflated, message) {
+			t.Errorf("Frame %d: inflated %d bytes instead of %d", i, len(inflated), len(message))
+		}
+	}
+	/* Compressed frames can be inflated by one zlib stream */
+	local, remote := NewStream(1, true)
+	local.CompressData = true
+	frames := make(chan *DataFrame, len(messages))
+	go func() {
+		for {
+			frame, err := remote.ReadFrame()
+			if err != nil {
+				return
+			}
+			if data, ok := frame.(*DataFrame); ok {
+				frames <- data
+			}
+		}
+	}()
+	if err := local.WriteFrame(&SynStreamFrame{StreamId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range messages {
+		if err := local.WriteFrame(&DataFrame{StreamId: 1, Data: message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffer.Reset()
+	var sent []int
+	for i := range messages {
+		select {
+			case data := <-frames: {
+				if data.Flags&DataFlagCompressed == 0 {
+					t.Errorf("Frame %d was not compressed", i)
+				}
+				sent = append(sent, len(data.Data))
+				buffer.Write(data.Data)
+			}
+			case <-time.After(time.Second):	t.Fatalf("%d frames were sent instead of %d", i, len(messages))
+		}
+	}
+	if sent[1] >= sent[0] {
+		t.Errorf("A frame repeating the previous one took %d bytes instead of less than %d", sent[1], sent[0])
+	}
+	decompressor, err := zlib.NewReader(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, message := range messages {
+		inflated := make([]byte, len(message))
+		if _, err := io.ReadFull(decompressor, inflated); err != nil || !bytes.Equal(inflated, message) {
+			t.Errorf("Frame %d could not be inflated: %v", i, err)
+		}
+	}
+}
+
+func TestRefuseCompressedData(t *testing.T) {
+	server := NewStreamSession(collectHandler(t), true)
+	server.RefuseCompressedData = true
+	client := NewSession(nil, false)
+	client.CompressData = true
+	go Splice(client, server, true)
+	defer server.Close()
+	defer client.Close()
+	stream, err := client.OpenStream(context.Background(), &http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.WriteDataFrame(bytes.Repeat([]byte("hello "), 100), true)
+	for {
+		frame, err := ReadFrameTimeout(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rst, ok := frame.(*RstStreamFrame); ok {
+			if rst.Status != ProtocolError {
+				t.Errorf("Unexpected status: %d", rst.Status)
+			}
+			break
+		}
+		if frame.GetFinFlag() {
+			t.Fatalf("The compressed data was accepted")
+		}
+	}
+}
+
+/* Send `body` on a new stream of `client`, through `tap`, and return the status of the RST_STREAM which refuses it */
+func compressedDataStatus(t *testing.T, client, server *Session, tap *compressionTap, body []byte) StatusCode {
+	tap.dst = server
+	go Copy(tap, client)
+	go Copy(client, server)
+	defer server.Close()
+	defer client.Close()
+	stream, err := client.OpenStream(context.Background(), &http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.WriteDataFrame(body, true)
+	for {
+		frame, err := ReadFrameTimeout(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rst, ok := frame.(*RstStreamFrame); ok {
+			return rst.Status
+		}
+		if frame.GetFinFlag() {
+			t.Fatalf("The compressed data was accepted")
+		}
+	}
+}
+
+func TestCompressedDataVersion3(t *testing.T) {
+	server := NewStreamSession(collectHandler(t), true)
+	server.Version = Version3
+	client := NewSession(nil, false)
+	client.Version = Version3
+	status := compressedDataStatus(t, client, server, &compressionTap{setFlag: true}, []byte("hello"))
+	if status != ProtocolError {
+		t.Errorf("Unexpected status: %d", status)
+	}
+}
+
+func TestCompressedDataPayloadLimit(t *testing.T) {
+	server := NewStreamSession(collectHandler(t), true)
+	server.framerPayload = 1000
+	client := NewSession(nil, false)
+	client.CompressData = true
+	status := compressedDataStatus(t, client, server, &compressionTap{}, bytes.Repeat([]byte("hello "), 1000))
+	if status != ProtocolError {
+		t.Errorf("Unexpected status: %d", status)
+	}
+}
+
+func TestHeaderCompressionLevel(t *testing.T) {
+	headers := http.Header{
+		"Url":     []string{"http://www.google.com/"},
+		"Method":  []string{"get"},
+		"Version": []string{"http/1.1"},
+	}
+	for _, level := range []int{zlib.NoCompression, zlib.BestSpeed, zlib.BestCompression} {
+		buffer := new(bytes.Buffer)
+		writer, _ := NewFramerVersion(buffer, buffer, Version3)
+		reader, _ := NewFramerVersion(buffer, buffer, Version3)
+		if err := writer.SetHeaderCompressionLevel(level); err != nil {
+			t.Fatal(err)
+		}
+		for i := uint32(1); i <= 5; i += 2 {
+			if err := writer.WriteFrame(&SynStreamFrame{StreamId: i, Headers: headers}); err != nil {
+				t.Fatal(err)
+			}
+			frame, err := reader.ReadFrame()
+			if err != nil {
+				t.Fatalf("Level %d: %s", level, err)
+			}
+			if !reflect.DeepEqual(frame.(*SynStreamFrame).Headers, headers) {
+				t.Errorf("Level %d: received %#v", level, frame.(*SynStreamFrame).Headers)
+			}
+		}
+		out, in := writer.HeaderStats(), reader.HeaderStats()
+		if out.RawOut != in.RawIn || out.CompressedOut != in.CompressedIn || out.RawOut == 0 {
+			t.Errorf("Level %d: sent %#v, received %#v", level, out, in)
+		}
+		if level == zlib.BestCompression && out.CompressedOut >= out.RawOut {
+			t.Errorf("Headers were not compressed: %#v", out)
+		}
+		if err := writer.SetHeaderCompressionLevel(zlib.BestSpeed); err == nil {
+			t.Errorf("Changed the compression level after sending headers")
+		}
+	}
+	framer, _ := NewFramer(new(bytes.Buffer), new(bytes.Buffer))
+	if err := framer.SetHeaderCompressionLevel(42); err == nil {
+		t.Errorf("Accepted an invalid compression level")
+	}
+}
+
+func TestDisableHeaderCompression(t *testing.T) {
+	headers := http.Header{"Url": []string{"/"}}
+	buffer := new(bytes.Buffer)
+	writer, _ := NewFramer(buffer, buffer)
+	reader, _ := NewFramer(buffer, buffer)
+	writer.DisableHeaderCompression()
+	reader.DisableHeaderCompression()
+	if err := writer.WriteFrame(&SynReplyFrame{StreamId: 1, Headers: headers}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buffer.Bytes(), []byte("url")) {
+		t.Errorf("The header block was compressed")
+	}
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(frame.(*SynReplyFrame).Headers, headers) {
+		t.Errorf("Received %#v", frame.(*SynReplyFrame).Headers)
+	}
+	if stats := writer.HeaderStats(); stats.RawOut != stats.CompressedOut {
+		t.Errorf("Unexpected stats: %#v", stats)
+	}
+	if err := writer.DisableHeaderCompression(); err == nil {
+		t.Errorf("Disabled compression after sending headers")
+	}
+}
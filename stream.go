@@ -9,11 +9,18 @@
 package spdy
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"context"
 	"net/http"
 	"errors"
 	"io"
 	"io/ioutil"
 	"fmt"
+	"os"
+	"sync"
+	"time"
 )
 
 
@@ -27,35 +34,74 @@ type Stream struct {
 	output		*StreamPipeWriter
 	errors		[]*Error
 	local		bool	// Was this stream created locally?
+	version		uint16	// Protocol version of the session
+	sendWindow	*sendWindow	// Flow control (version 3 and up). Shared with the peer.
+	recvWindow	*recvWindow
+	sessionWindow	*sendWindow	// Session-wide flow control (version 3.1 and up)
 	sendErrors	bool
-	Closed		bool
-	// FIXME: unidirectional
-	// FIXME: priority
+	finSent		bool	// Half-close state, maintained by the session
+	finReceived	bool
+	Closed		bool	// Read it with IsClosed() if the stream is shared between goroutines
+	lock		sync.Mutex	// Protects errors, Closed and writing
+	session		*Session
+	unidirectional	bool	// Only the initiator of the stream can send
+	associatedTo	uint32	// Stream this one is pushed for, if any
+	Priority	uint16	// 0 is the highest. Up to 3 in version 2, and 7 in version 3. Set it before Syn
+	ctx		context.Context	// Shared with the peer. Cancelled when the stream is closed
+	cancel		context.CancelFunc
+	readDeadline	*deadline
+	writeDeadline	*deadline
+	writing		int	// Number of writes in progress, which fail if the write deadline passes
+	CompressData	bool	// Compress the DATA frames we send, with one zlib stream for the whole stream. Set it before writing. Version 2 only
+	compressLock	sync.Mutex	// Protects the compressor, and orders compressed frames
+	compressBuf	bytes.Buffer
+	compressor	*zlib.Writer
+	decompressor	io.ReadCloser
+	inflating	bool	// Set once the zlib header of the peer's compressed DATA frames was read
+	inflateHistory	[]byte	// The last 32KB inflated, which the next frame can refer to
 }
 
 func NewStream(id uint32, local bool) (*Stream, *Stream) {
 	debug("NewStream(%d)", id)
 	inputR, inputW := StreamPipe(id, local)
 	outputR, outputW := StreamPipe(id, !local)
-	stream := &Stream{input: inputR,  output: outputW, sendErrors: false, Id: id, local: local}
-	peer   := &Stream{input: outputR, output:  inputW, sendErrors: true,  Id: id, local: local}
+	stream := &Stream{input: inputR,  output: outputW, sendErrors: false, Id: id, local: local, version: Version}
+	peer   := &Stream{input: outputR, output:  inputW, sendErrors: true,  Id: id, local: local, version: Version}
+	stream.readDeadline = newDeadline(nil)
+	stream.writeDeadline = newDeadline(stream.writeExpired)
 	return stream, peer
 }
 
 func (s *Stream) ReadFrame() (Frame, error) {
 	// Inject errors, if any
+	s.lock.Lock()
 	if len(s.errors) > 0 {
 		err := s.errors[len(s.errors) - 1]
 		s.errors = s.errors[:len(s.errors) - 1]
+		s.lock.Unlock()
 		return err.ToFrame(), nil
 	}
-	frame, err := s.input.ReadFrame()
+	s.lock.Unlock()
+	frame, err := s.input.readFrame(s.readDeadline.wait())
 	if err != nil {
 		return nil, err
 	}
 	if _, isRst := frame.(*RstStreamFrame); isRst {
 		s.Close()
 	}
+	/* Tell the peer it can send more data */
+	if data, isData := frame.(*DataFrame); isData && s.recvWindow != nil && !s.sendErrors {
+		if err := s.recvWindow.consume(len(data.Data)); err != nil {
+			return nil, err
+		}
+	}
+	if data, isData := frame.(*DataFrame); isData && data.Flags&DataFlagCompressed != 0 && !s.sendErrors {
+		inflated, err := s.inflate(data.Data)
+		if err != nil {
+			return nil, err
+		}
+		frame = &DataFrame{StreamId: data.StreamId, Flags: data.Flags &^ DataFlagCompressed, Data: inflated}
+	}
 	s.debug("Received %#v err=%#v", frame, err)
 	return frame, nil
 }
@@ -65,6 +111,203 @@ func (s *Stream) debug(msg string, args ...interface{}) {
 }
 
 func (s *Stream) WriteFrame(frame Frame) error {
+	/* RST_STREAM never blocks, and must get through to reset the stream after a timeout */
+	if _, isRst := frame.(*RstStreamFrame); !isRst {
+		s.lock.Lock()
+		s.writing += 1
+		s.lock.Unlock()
+		defer func() {
+			s.lock.Lock()
+			s.writing -= 1
+			s.lock.Unlock()
+		}()
+		if s.writeDeadline.passed() {
+			return os.ErrDeadlineExceeded
+		}
+	}
+	var err error
+	data, isData := frame.(*DataFrame)
+	if syn, isSyn := frame.(*SynStreamFrame); isSyn && s.local && s.session != nil {
+		/* Local streams get their id when they send SYN_STREAM */
+		err = s.session.sendSyn(s, syn)
+	} else if isData && s.sendWindow != nil && !s.sendErrors {
+		/* Local writes of DATA frames are subject to flow control */
+		err = s.writeDataFrame(data)
+	} else if isData && s.CompressData && s.version < Version3 && !s.sendErrors {
+		err = s.writeCompressed(data)
+	} else {
+		err = s.writeFrame(frame)
+	}
+	if err != nil && s.writeDeadline.passed() {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+/* Reset the stream if the write deadline passes while a write is blocked */
+func (s *Stream) writeExpired() {
+	s.lock.Lock()
+	writing := s.writing
+	s.lock.Unlock()
+	if writing > 0 {
+		s.debug("Write deadline exceeded: resetting")
+		s.abort(Cancel, os.ErrDeadlineExceeded)
+	}
+}
+
+/*
+ * Set the read and write deadlines of the stream. See SetReadDeadline and SetWriteDeadline.
+ */
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+/*
+ * Make ReadFrame fail with os.ErrDeadlineExceeded once `t` passes, without losing frames.
+ * The zero time means no deadline.
+ */
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+/*
+ * Make writes fail with os.ErrDeadlineExceeded once `t` passes. A write still blocked
+ * on flow control at that time may have been partially sent: the stream is reset with
+ * Cancel. The zero time means no deadline.
+ */
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+/*
+ * Write a DATA frame without exceeding the send window, splitting it if necessary.
+ * Block until the peer opens the window.
+ */
+func (s *Stream) writeDataFrame(frame *DataFrame) error {
+	data := frame.Data
+	for {
+		n, err := s.sendWindow.take(len(data), nil)
+		if err != nil {
+			return &Error{StreamClosed, s.Id}
+		}
+		if s.sessionWindow != nil {
+			/* Also take from the session window, and give back what we can't use */
+			m, err := s.sessionWindow.take(n, s.sendWindow)
+			s.sendWindow.add(int64(n - m))
+			if err != nil {
+				return &Error{StreamClosed, s.Id}
+			}
+			n = m
+		}
+		chunk := &DataFrame{StreamId: frame.StreamId, Data: data[:n], Flags: frame.Flags}
+		if n < len(data) {
+			chunk.Flags &^= DataFlagFin
+		}
+		if err := s.writeFrame(chunk); err != nil {
+			if s.sessionWindow != nil {
+				s.sessionWindow.add(int64(n))
+			}
+			return err
+		}
+		data = data[n:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+/*
+ * Compress `frame` and send it. Like header blocks, the DATA frames of a stream share a
+ * single zlib stream: each frame carries what was written since the previous one, with
+ * a sync flush, so that the peer can inflate it as soon as it arrives. Frames are sent
+ * under compressLock, so that they leave in the order they were compressed.
+ */
+func (s *Stream) writeCompressed(frame *DataFrame) error {
+	s.compressLock.Lock()
+	defer s.compressLock.Unlock()
+	if len(frame.Data) == 0 {
+		/* Nothing to add to the zlib stream: eg. FIN */
+		return s.writeFrame(frame)
+	}
+	s.compressBuf.Reset()
+	if s.compressor == nil {
+		s.compressor = zlib.NewWriter(&s.compressBuf)
+	}
+	if _, err := s.compressor.Write(frame.Data); err != nil {
+		return err
+	}
+	if err := s.compressor.Flush(); err != nil {
+		return err
+	}
+	compressed := &DataFrame{
+		StreamId:	frame.StreamId,
+		Flags:		frame.Flags | DataFlagCompressed,
+		Data:		append([]byte(nil), s.compressBuf.Bytes()...),
+	}
+	return s.writeFrame(compressed)
+}
+
+/*
+ * Inflate the payload of a compressed DATA frame, up to the payload limit of the
+ * session's Framer.
+ *
+ * A sync-flushed frame leaves the deflate stream at a block boundary: the next frame
+ * is inflated by a fresh reader, primed with the last 32KB of output. This avoids the
+ * sticky error which a reader running out of input mid-stream would keep.
+ */
+func (s *Stream) inflate(data []byte) ([]byte, error) {
+	limit := DefaultMaxFramePayload
+	if s.session != nil {
+		limit = s.session.maxFramePayload()
+	}
+	if !s.inflating {
+		/* The first frame starts with the zlib header */
+		if len(data) < 2 || data[0]&0x0f != zlibDeflate || data[1]&zlibPresetDict != 0 || (uint16(data[0]) << 8 | uint16(data[1])) % 31 != 0 {
+			return nil, &Error{InvalidDataFrame, s.Id}
+		}
+		data = data[2:]
+		s.inflating = true
+		s.inflateHistory = nil
+	}
+	if s.decompressor == nil {
+		s.decompressor = flate.NewReaderDict(bytes.NewReader(data), s.inflateHistory)
+	} else if err := s.decompressor.(flate.Resetter).Reset(bytes.NewReader(data), s.inflateHistory); err != nil {
+		return nil, &Error{InvalidDataFrame, s.Id}
+	}
+	inflated, err := ioutil.ReadAll(io.LimitReader(s.decompressor, int64(limit) + 1))
+	if len(inflated) > limit {
+		return nil, &Error{PayloadTooLarge, s.Id}
+	}
+	switch {
+		case err == nil:
+			/* The peer ended its zlib stream: the next compressed frame starts a new one */
+			s.inflating = false
+		case err == io.ErrUnexpectedEOF && bytes.HasSuffix(data, syncFlushMarker):
+			/* The frame ends with a sync flush: more will follow */
+		default:
+			return nil, &Error{InvalidDataFrame, s.Id}
+	}
+	history := append(s.inflateHistory, inflated...)
+	if len(history) > maxInflateHistory {
+		history = append([]byte(nil), history[len(history) - maxInflateHistory:]...)
+	}
+	s.inflateHistory = history
+	return inflated, nil
+}
+
+const (
+	zlibDeflate		= 8	// Compression method of zlib streams, in the first byte
+	zlibPresetDict		= 0x20	// Flag of the second byte, unused by DATA frames
+	maxInflateHistory	= 1 << 15	// Size of the deflate window
+)
+
+/* The empty stored block which ends a sync flush */
+var syncFlushMarker = []byte{0, 0, 0xff, 0xff}
+
+func (s *Stream) writeFrame(frame Frame) error {
 	s.debug("Passing %#v", frame)
 	err := s.output.WriteFrame(frame)
 	if err != nil {
@@ -75,7 +318,9 @@ func (s *Stream) WriteFrame(frame Frame) error {
 			// loops [...]
 			if _, receivedRst := frame.(*RstStreamFrame); !receivedRst {
 				s.debug("Sending error (%s) as RST_STREAM frame", e)
+				s.lock.Lock()
 				s.errors = append(s.errors, e)
+				s.lock.Unlock()
 			}
 			return nil
 		}
@@ -90,14 +335,53 @@ func (s *Stream) WriteFrame(frame Frame) error {
 }
 
 func (s *Stream) Close() {
+	s.lock.Lock()
 	if s.Closed {
+		s.lock.Unlock()
 		return
 	}
 	s.Closed = true
+	s.lock.Unlock()
 	s.output.Close()
 	s.input.Close()
+	if s.sendWindow != nil {
+		s.sendWindow.close()
+	}
+	if s.sessionWindow != nil {
+		s.sessionWindow.wake()
+	}
+	if s.recvWindow != nil {
+		s.recvWindow.close()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+/*
+ * Return the context of the stream. It is cancelled once the stream is closed, which
+ * happens when either side resets it, or when its session ends.
+ * For server streams, it is also the context of the request passed to the handler.
+ */
+func (s *Stream) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
 }
 
+func (s *Stream) IsClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Closed
+}
+
+/* Close the stream, and make reads and writes on both ends fail with `err` */
+func (s *Stream) closeWithError(err error) {
+	s.input.CloseWithError(err)
+	s.output.CloseWithError(err)
+	s.Close()
+}
 
 func (s *Stream) Reply(headers *http.Header, fin bool) error {
 	if headers == nil {
@@ -115,6 +399,18 @@ func (s *Stream) Reply(headers *http.Header, fin bool) error {
 }
 
 func (s *Stream) Syn(headers *http.Header, fin bool) error {
+	frame := newSynStreamFrame(headers, fin)
+	frame.StreamId = s.Id
+	frame.AssociatedToStreamId = s.associatedTo
+	frame.Priority = s.Priority
+	if s.unidirectional {
+		frame.CFHeader.Flags |= ControlFlagUnidirectional
+	}
+	return s.WriteFrame(frame)
+}
+
+/* Return a SYN_STREAM frame carrying `headers`, with FLAG_FIN if `fin` is true. The caller sets the stream id */
+func newSynStreamFrame(headers *http.Header, fin bool) *SynStreamFrame {
 	if headers == nil {
 		headers = new(http.Header)
 	}
@@ -122,11 +418,10 @@ func (s *Stream) Syn(headers *http.Header, fin bool) error {
 	if fin {
 		flags = ControlFlagFin
 	}
-	return s.WriteFrame(&SynStreamFrame{
-		StreamId:	s.Id,
+	return &SynStreamFrame{
 		Headers:	*headers,
 		CFHeader:	ControlFrameHeader{Flags:flags},
-	})
+	}
 }
 
 func (s *Stream) WriteHeadersFrame(headers *http.Header, fin bool) error {
@@ -157,8 +452,9 @@ func (s *Stream) WriteDataFrame(data []byte, fin bool) error {
 }
 
 func (s *Stream) CopyFrom(src io.Reader) error {
-	data := make([]byte, 4096)
 	for {
+		/* The frame is queued until it is sent: don't reuse its buffer */
+		data := make([]byte, 4096)
 		n, err := src.Read(data)
 		if err == io.EOF {
 			return nil
@@ -169,26 +465,70 @@ func (s *Stream) CopyFrom(src io.Reader) error {
 			return err
 		}
 	}
-	return nil
 }
 
 func (s *Stream) Rst(status StatusCode) error {
-	return s.WriteFrame(&RstStreamFrame{StreamId: s.Id, Status: status})
+	err := s.WriteFrame(&RstStreamFrame{StreamId: s.Id, Status: status})
+	if e, ok := err.(*Error); ok && e.Err == StreamClosed && s.session != nil && !s.IsClosed() {
+		/* We already sent FIN, so the output of the stream is closed: go through the session */
+		s.Close()
+		return s.session.resetStream(s.Id, status)
+	}
+	return err
 }
 
+/* Reset the stream with `status`, and make reads fail with `err` */
+func (s *Stream) abort(status StatusCode, err error) error {
+	s.input.CloseWithError(err)
+	return s.Rst(status)
+}
+
+/*
+ * A StreamHandler serves the streams opened by the peer. It reads the SYN_STREAM
+ * and the frames which follow with stream.ReadFrame(), and replies on the stream.
+ * The stream should be closed or reset when ServeStream returns.
+ */
+type StreamHandler interface {
+	ServeStream(stream *Stream)
+}
+
+/* A StreamHandlerFunc is a function used as a StreamHandler */
+type StreamHandlerFunc func(stream *Stream)
+
+func (f StreamHandlerFunc) ServeStream(stream *Stream) {
+	f(stream)
+}
+
+/* Return a StreamHandler which serves each stream as an HTTP request to `handler`. nil stays nil. */
+func HTTPHandler(handler http.Handler) StreamHandler {
+	if handler == nil {
+		return nil
+	}
+	return httpHandler{handler}
+}
+
+type httpHandler struct {
+	handler	http.Handler
+}
+
+func (h httpHandler) ServeStream(stream *Stream) {
+	stream.Serve(h.handler)
+}
+
+/* Parse the stream as an HTTP request, and pass it to `handler` */
 func (stream *Stream) Serve(handler http.Handler) {
 	stream.debug("Running handler")
 	if handler == nil {
 		stream.Rst(RefusedStream)
 		return
 	}
-	w := &ResponseWriter{Stream: stream}
 	r, err := stream.ParseHTTPRequest();
 	if err != nil {
 		// FIXME: send error
 		stream.debug("Error parsing http request: %s\n", err)
 		return
 	}
+	w := &ResponseWriter{Stream: stream, request: r, handler: handler}
 	handler.ServeHTTP(w, r)
 	stream.debug("Handler returned. Cleaning up.")
 	stream.WriteDataFrame(nil, true) // Close the stream in case the handler hasn't
@@ -200,7 +540,7 @@ func (stream *Stream) Serve(handler http.Handler) {
 }
 
 func (s *Stream) ParseHTTPRequest() (*http.Request, error) {
-	if s.input.NFrames > 0 {
+	if s.input.nFrames() > 0 {
 		return nil, errors.New("Can't parse HTTP request: first SPDY frame already read")
 	}
 	frame, err := s.ReadFrame()
@@ -208,25 +548,31 @@ func (s *Stream) ParseHTTPRequest() (*http.Request, error) {
 		return nil, err
 	}
 	headers := frame.GetHeaders()
-	method := headers.Get("method")
+	/* Version 3 prefixes special headers with ':', and moves the host out of url */
+	method, path, host := headers.Get("method"), headers.Get("url"), headers.Get("host")
+	if s.version >= Version3 {
+		method, path, host = headers.Get(":method"), headers.Get(":path"), headers.Get(":host")
+	}
 	if method == "" {
 		method = "GET"
 	}
 	s.debug("headers = %#v", *headers)
-	path := headers.Get("url")
 	if path == "" {
 		path = "/"
 	}
-	s.debug("path = %s", (*headers)["url"])
+	s.debug("path = %s", path)
 	bodyReader, bodyWriter := io.Pipe()
 	go func() {
 		ExtractData(s, bodyWriter)
 		bodyWriter.Close()
 	}()
-	r, err := http.NewRequest(method, path, bodyReader)
+	r, err := http.NewRequestWithContext(s.Context(), method, path, bodyReader)
 	if err != nil {
 		return nil, err
 	}
+	if host != "" {
+		r.Host = host
+	}
 	UpdateHeaders(&r.Header, headers)
 	return r, nil
 }
@@ -245,19 +591,26 @@ type StreamPipeReader struct {
 
 type StreamPipeWriter struct {
 	*PipeWriter
+	lock	sync.Mutex	// Serializes writes, which check and update the state below
 	reply	bool	// If true, must start with SYN_REPLY. Otherwise must start with SYN_STREAM
+	rstOnly	bool	// Closed side of a unidirectional stream: only RST_STREAM is allowed
 	closed	bool
 	id	uint32
 	Headers	http.Header
 }
 
 func (p *StreamPipeWriter) WriteFrame(frame Frame) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if p.closed {
 		return &Error{StreamClosed, p.id}
 	}
 	if id, exists := frame.GetStreamId(); !exists || id != p.id {
 		return errors.New("Wrong stream ID")
 	}
+	if _, isRst := frame.(*RstStreamFrame); p.rstOnly && !isRst {
+		return &Error{IllegalUnidirectional, p.id}
+	}
 	// Check for the correct sequence of frames
 	switch frame.(type) {
 		// SYN_STREAM is only allowed as the first frame and if reply=false
@@ -272,6 +625,8 @@ func (p *StreamPipeWriter) WriteFrame(frame Frame) error {
 				return &Error{IllegalSynReply, p.id}
 			}
 		}
+		// RST_STREAM is allowed at any time, eg. to refuse a pushed stream
+		case *RstStreamFrame:
 		// Any other frames are forbidden as the first frame
 		default: {
 			if p.NFrames == 0 {
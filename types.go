@@ -11,8 +11,10 @@ package spdy
 import (
 	"bytes"
 	"compress/zlib"
+	"errors"
 	"io"
 	"net/http"
+	"sync/atomic"
 )
 
 type Handler http.Handler
@@ -126,9 +128,15 @@ type Handler http.Handler
 //  |   Delta-Window-Size (32 bits)    |
 //  +----------------------------------+
 
-// Version is the protocol version number that this package implements.
+// Version is the default protocol version, used by NewFramer and NewSession.
 const Version = 2
 
+// Protocol versions supported by Framer.
+const (
+	Version2 = 2
+	Version3 = 3
+)
+
 // ControlFrameType stores the type field in a control frame header.
 type ControlFrameType uint16
 
@@ -149,7 +157,9 @@ const (
 type ControlFlags uint8
 
 const (
-	ControlFlagFin ControlFlags = 0x01
+	ControlFlagFin                   ControlFlags = 0x01
+	ControlFlagUnidirectional                     = 0x02 // SYN_STREAM frames only
+	ControlFlagSettingsClearSettings              = 0x01 // SETTINGS frames only
 )
 
 // DataFlags are the flags that can be set on a data frame.
@@ -197,9 +207,10 @@ type SynStreamFrame struct {
 	CFHeader             ControlFrameHeader
 	StreamId             uint32
 	AssociatedToStreamId uint32
-	// Note, only 2 highest bits currently used
-	// Rest of Priority is unused.
+	// Note, only 2 bits are used in version 2 (0-3), 3 bits in version 3 (0-7).
+	// In both versions, 0 is the highest priority.
 	Priority uint16
+	Slot     uint8 // introduced in version 3
 	Headers  http.Header
 }
 
@@ -214,14 +225,17 @@ type SynReplyFrame struct {
 type StatusCode uint32
 
 const (
-	ProtocolError      StatusCode = 1
-	InvalidStream                 = 2
-	RefusedStream                 = 3
-	UnsupportedVersion            = 4
-	Cancel                        = 5
-	InternalError                 = 6
-	FlowControlError              = 7
-	StreamAlreadyClosed           = 9 // introduced in version 3
+	ProtocolError       StatusCode = 1
+	InvalidStream                  = 2
+	RefusedStream                  = 3
+	UnsupportedVersion             = 4
+	Cancel                         = 5
+	InternalError                  = 6
+	FlowControlError               = 7
+	StreamInUse                    = 8  // introduced in version 3
+	StreamAlreadyClosed            = 9  // introduced in version 3
+	InvalidCredentials             = 10 // introduced in version 3
+	FrameTooLarge                  = 11 // introduced in version 3
 )
 
 // RstStreamFrame is the unpacked, in-memory representation of a RST_STREAM
@@ -244,11 +258,14 @@ const (
 type SettingsId uint32
 
 const (
-	SettingsUploadBandwidth      SettingsId = 1
-	SettingsDownloadBandwidth               = 2
-	SettingsRoundTripTime                   = 3
-	SettingsMaxConcurrentStreams            = 4
-	SettingsCurrentCwnd                     = 5
+	SettingsUploadBandwidth             SettingsId = 1
+	SettingsDownloadBandwidth                      = 2
+	SettingsRoundTripTime                          = 3
+	SettingsMaxConcurrentStreams                   = 4
+	SettingsCurrentCwnd                            = 5
+	SettingsDownloadRetransRate                    = 6 // introduced in version 3
+	SettingsInitialWindowSize                      = 7 // introduced in version 3
+	SettingsClientCertificateVectorSize            = 8 // introduced in version 3
 )
 
 // SettingsFlagIdValue is the unpacked, in-memory representation of the
@@ -277,10 +294,20 @@ type PingFrame struct {
 	Id       uint32
 }
 
+// GoAwayStatus represents the status in a GOAWAY frame.
+type GoAwayStatus uint32
+
+const (
+	GoAwayOK            GoAwayStatus = 0
+	GoAwayProtocolError              = 1
+	GoAwayInternalError              = 2
+)
+
 // GoAwayFrame is the unpacked, in-memory representation of a GOAWAY frame.
 type GoAwayFrame struct {
 	CFHeader         ControlFrameHeader
 	LastGoodStreamId uint32
+	Status           GoAwayStatus // introduced in version 3
 }
 
 // HeadersFrame is the unpacked, in-memory representation of a HEADERS frame.
@@ -290,6 +317,38 @@ type HeadersFrame struct {
 	Headers  http.Header
 }
 
+// WindowUpdateFrame is the unpacked, in-memory representation of a
+// WINDOW_UPDATE frame.
+type WindowUpdateFrame struct {
+	CFHeader        ControlFrameHeader
+	StreamId        uint32
+	DeltaWindowSize uint32
+}
+
+// UnknownFrame is a control frame of a type or version which the Framer doesn't
+// know. Its payload is read but not parsed, and sessions ignore it, as required
+// by the spec, so that extensions from newer peers don't break the connection.
+// The exception is a SYN_STREAM of another version, which is refused with
+// UNSUPPORTED_VERSION.
+//
+// Frames of a type registered with RegisterControlFrame are read as an UnknownFrame
+// too when their payload can't be decoded. Err holds the error of ReadPayload then.
+type UnknownFrame struct {
+	CFHeader ControlFrameHeader
+	Payload  []byte
+	Err      error
+}
+
+// Type returns the type of the control frame.
+func (frame *UnknownFrame) Type() ControlFrameType {
+	return frame.CFHeader.frameType
+}
+
+// Version returns the protocol version of the control frame.
+func (frame *UnknownFrame) Version() uint16 {
+	return frame.CFHeader.version
+}
+
 // DataFrame is the unpacked, in-memory representation of a DATA frame.
 type DataFrame struct {
 	// Note, high bit is the "Control" bit. Should be 0 for data frames.
@@ -314,6 +373,89 @@ const HeaderDictionary = "optionsgetheadpostputdeletetrace" +
 	"chunkedtext/htmlimage/pngimage/jpgimage/gifapplication/xmlapplication/xhtmltext/plainpublicmax-age" +
 	"charset=iso-8859-1utf-8gzipdeflateHTTP/1.1statusversionurl\x00"
 
+// HeaderDictionaryV3 is the dictionary sent to the zlib compressor/decompressor
+// in version 3. Unlike HeaderDictionary, each of its leading entries is prefixed
+// with its length as a 32-bit integer.
+const HeaderDictionaryV3 = "\x00\x00\x00\x07options" +
+	"\x00\x00\x00\x04head" +
+	"\x00\x00\x00\x04post" +
+	"\x00\x00\x00\x03put" +
+	"\x00\x00\x00\x06delete" +
+	"\x00\x00\x00\x05trace" +
+	"\x00\x00\x00\x06accept" +
+	"\x00\x00\x00\x0eaccept-charset" +
+	"\x00\x00\x00\x0faccept-encoding" +
+	"\x00\x00\x00\x0faccept-language" +
+	"\x00\x00\x00\x0daccept-ranges" +
+	"\x00\x00\x00\x03age" +
+	"\x00\x00\x00\x05allow" +
+	"\x00\x00\x00\x0dauthorization" +
+	"\x00\x00\x00\x0dcache-control" +
+	"\x00\x00\x00\x0aconnection" +
+	"\x00\x00\x00\x0ccontent-base" +
+	"\x00\x00\x00\x10content-encoding" +
+	"\x00\x00\x00\x10content-language" +
+	"\x00\x00\x00\x0econtent-length" +
+	"\x00\x00\x00\x10content-location" +
+	"\x00\x00\x00\x0bcontent-md5" +
+	"\x00\x00\x00\x0dcontent-range" +
+	"\x00\x00\x00\x0ccontent-type" +
+	"\x00\x00\x00\x04date" +
+	"\x00\x00\x00\x04etag" +
+	"\x00\x00\x00\x06expect" +
+	"\x00\x00\x00\x07expires" +
+	"\x00\x00\x00\x04from" +
+	"\x00\x00\x00\x04host" +
+	"\x00\x00\x00\x08if-match" +
+	"\x00\x00\x00\x11if-modified-since" +
+	"\x00\x00\x00\x0dif-none-match" +
+	"\x00\x00\x00\x08if-range" +
+	"\x00\x00\x00\x13if-unmodified-since" +
+	"\x00\x00\x00\x0dlast-modified" +
+	"\x00\x00\x00\x08location" +
+	"\x00\x00\x00\x0cmax-forwards" +
+	"\x00\x00\x00\x06pragma" +
+	"\x00\x00\x00\x12proxy-authenticate" +
+	"\x00\x00\x00\x13proxy-authorization" +
+	"\x00\x00\x00\x05range" +
+	"\x00\x00\x00\x07referer" +
+	"\x00\x00\x00\x0bretry-after" +
+	"\x00\x00\x00\x06server" +
+	"\x00\x00\x00\x02te" +
+	"\x00\x00\x00\x07trailer" +
+	"\x00\x00\x00\x11transfer-encoding" +
+	"\x00\x00\x00\x07upgrade" +
+	"\x00\x00\x00\x0auser-agent" +
+	"\x00\x00\x00\x04vary" +
+	"\x00\x00\x00\x03via" +
+	"\x00\x00\x00\x07warning" +
+	"\x00\x00\x00\x10www-authenticate" +
+	"\x00\x00\x00\x06method" +
+	"\x00\x00\x00\x03get" +
+	"\x00\x00\x00\x06status" +
+	"\x00\x00\x00\x06200 OK" +
+	"\x00\x00\x00\x07version" +
+	"\x00\x00\x00\x08HTTP/1.1" +
+	"\x00\x00\x00\x03url" +
+	"\x00\x00\x00\x06public" +
+	"\x00\x00\x00\x0aset-cookie" +
+	"\x00\x00\x00\x0akeep-alive" +
+	"\x00\x00\x00\x06origin" +
+	"100101201202205206300302303304305306307402405406407408409410411412413414415416417502504505" +
+	"203 Non-Authoritative Information204 No Content301 Moved Permanently400 Bad Request401 Unauthorized" +
+	"403 Forbidden404 Not Found500 Internal Server Error501 Not Implemented503 Service Unavailable" +
+	"Jan Feb Mar Apr May Jun Jul Aug Sept Oct Nov Dec 00:00:00 Mon, Tue, Wed, Thu, Fri, Sat, Sun, GMT" +
+	"chunked,text/html,image/png,image/jpg,image/gif,application/xml,application/xhtml+xml,text/plain,text/javascript," +
+	"publicprivatemax-age=gzip,deflate,sdchcharset=utf-8charset=iso-8859-1,utf-,*,enq=0."
+
+// headerDictionary returns the zlib dictionary for a given protocol version.
+func headerDictionary(version uint16) []byte {
+	if version >= Version3 {
+		return []byte(HeaderDictionaryV3)
+	}
+	return []byte(HeaderDictionary)
+}
+
 // A SPDY specific error.
 type ErrorCode string
 
@@ -331,6 +473,20 @@ const (
 	StreamClosed               ErrorCode = "stream is closed"
 	NoSuchStream               ErrorCode = "no such stream"
 	InvalidStreamId            ErrorCode = "illegal stream id"
+	FlowControlViolation       ErrorCode = "flow control window exceeded"
+	InvalidWindowUpdate        ErrorCode = "window update with a delta of 0"
+	UnsupportedVersionNumber   ErrorCode = "unsupported protocol version"
+	UnsupportedProtocol        ErrorCode = "no SPDY protocol was negotiated"
+	TooManyStreams             ErrorCode = "too many concurrent streams"
+	InvalidSettingValue        ErrorCode = "invalid setting value"
+	SessionGoingAway           ErrorCode = "session is going away"
+	StreamNotProcessed         ErrorCode = "stream was not processed by the peer, and can be retried"
+	IllegalUnidirectional      ErrorCode = "frame sent on the closed side of a unidirectional stream"
+	StreamReset                ErrorCode = "stream was reset by the peer"
+	TooManyHeaders             ErrorCode = "header block has too many headers"
+	HeadersTooLarge            ErrorCode = "header block exceeds the size limit"
+	PayloadTooLarge            ErrorCode = "frame payload exceeds the size limit"
+	CompressedDataRefused      ErrorCode = "compressed DATA frames are refused"
 )
 
 // Error contains both the type of error and additional values. StreamId is 0
@@ -350,6 +506,12 @@ func (e *Error) ToFrame() *RstStreamFrame {
 	switch e.Err {
 		case StreamClosed:
 			status = StreamAlreadyClosed
+		case FlowControlViolation:
+			status = FlowControlError
+		case TooManyStreams:
+			status = RefusedStream
+		case PayloadTooLarge:
+			status = FrameTooLarge
 		default:
 			status = ProtocolError
 	}
@@ -399,6 +561,7 @@ type ReadWriter interface {
 // Framer handles serializing/deserializing SPDY frames, including compressing/
 // decompressing payloads.
 type Framer struct {
+	version                   uint16
 	headerCompressionDisabled bool
 	w                         io.Writer
 	headerBuf                 *bytes.Buffer
@@ -406,19 +569,81 @@ type Framer struct {
 	r                         io.Reader
 	headerReader              io.LimitedReader
 	headerDecompressor        io.ReadCloser
+	// Limits on received frames, enforced before allocating anything. Violations make
+	// ReadFrame fail with TooManyHeaders, HeadersTooLarge or PayloadTooLarge. After
+	// PayloadTooLarge, the Framer can't be used anymore. After the others, the frame is
+	// skipped, but header blocks can't be decompressed anymore: the frames which carry
+	// one fail with the same error. The defaults apply if they are 0.
+	MaxHeaders                int // Number of headers in a header block
+	MaxHeaderBytes            int // Size of a decompressed header block
+	MaxFramePayload           int // Size of the payload of a frame
+	headerLimitErr            ErrorCode // Set once a header block exceeded the limits, and was skipped
+	rawHeaderOut              atomic.Int64 // Header block bytes, before compression
+	compressedHeaderOut       atomic.Int64
+	rawHeaderIn               atomic.Int64 // Header block bytes, after decompression
+	compressedHeaderIn        atomic.Int64
+}
+
+// HeaderStats counts the bytes of the header blocks sent and received by a Framer,
+// before compression (Raw) and on the wire (Compressed).
+type HeaderStats struct {
+	RawOut        int64
+	CompressedOut int64
+	RawIn         int64
+	CompressedIn  int64
+}
+
+// HeaderCompression configures the header compression of the sessions of a Server
+// or Transport. Level is a zlib level, from zlib.NoCompression to zlib.BestCompression
+// (see Framer.SetHeaderCompressionLevel). If Disabled, header blocks are sent and
+// expected without zlib, and Level is ignored (see Framer.DisableHeaderCompression).
+type HeaderCompression struct {
+	Level    int
+	Disabled bool
 }
 
+// apply configures a new Framer. A nil HeaderCompression leaves the defaults.
+func (c *HeaderCompression) apply(f *Framer) error {
+	if c == nil {
+		return nil
+	}
+	if c.Disabled {
+		return f.DisableHeaderCompression()
+	}
+	return f.SetHeaderCompressionLevel(c.Level)
+}
+
+const (
+	DefaultMaxHeaders      = 1000
+	DefaultMaxHeaderBytes  = 1 << 20
+	DefaultMaxFramePayload = 0xffffff // The largest payload a frame can carry
+)
+
 // NewFramer allocates a new Framer for a given SPDY connection, repesented by
 // a io.Writer and io.Reader. Note that Framer will read and write individual fields
 // from/to the Reader and Writer, so the caller should pass in an appropriately
 // buffered implementation to optimize performance.
+//
+// The Framer speaks the default protocol Version. Use NewFramerVersion to pick
+// another version.
 func NewFramer(w io.Writer, r io.Reader) (*Framer, error) {
+	return NewFramerVersion(w, r, Version)
+}
+
+// NewFramerVersion is like NewFramer, but the returned Framer speaks the given
+// protocol version (Version2 or Version3). Frames carrying any other version
+// are rejected by ReadFrame.
+func NewFramerVersion(w io.Writer, r io.Reader, version uint16) (*Framer, error) {
+	if version != Version2 && version != Version3 {
+		return nil, &Error{UnsupportedVersionNumber, 0}
+	}
 	compressBuf := new(bytes.Buffer)
-	compressor, err := zlib.NewWriterLevelDict(compressBuf, zlib.BestCompression, []byte(HeaderDictionary))
+	compressor, err := zlib.NewWriterLevelDict(compressBuf, zlib.BestCompression, headerDictionary(version))
 	if err != nil {
 		return nil, err
 	}
 	framer := &Framer{
+		version:          version,
 		w:                w,
 		headerBuf:        compressBuf,
 		headerCompressor: compressor,
@@ -426,3 +651,49 @@ func NewFramer(w io.Writer, r io.Reader) (*Framer, error) {
 	}
 	return framer, nil
 }
+
+// Version returns the protocol version spoken by the Framer.
+func (f *Framer) Version() uint16 {
+	return f.version
+}
+
+// SetHeaderCompressionLevel sets the zlib compression level of the header blocks
+// the Framer sends, from zlib.NoCompression to zlib.BestCompression (the default).
+// Higher levels save bandwidth, at the cost of CPU. The level can't be changed once
+// a header block was sent, since the compression context is shared with the peer.
+// It must be called before the Framer is used: the check doesn't synchronize with
+// WriteFrame, so calling it concurrently with a write is a data race.
+func (f *Framer) SetHeaderCompressionLevel(level int) error {
+	if f.rawHeaderOut.Load() != 0 {
+		return errors.New("spdy: header blocks were already sent")
+	}
+	compressor, err := zlib.NewWriterLevelDict(f.headerBuf, level, headerDictionary(f.version))
+	if err != nil {
+		return err
+	}
+	f.headerCompressor = compressor
+	return nil
+}
+
+// DisableHeaderCompression makes the Framer send and expect header blocks without
+// zlib. This is not allowed by the protocol, and is only meant for debugging, with
+// a peer which does the same. Like SetHeaderCompressionLevel, it must be called
+// before the Framer is used, and not concurrently with ReadFrame or WriteFrame.
+func (f *Framer) DisableHeaderCompression() error {
+	if f.rawHeaderOut.Load() != 0 || f.compressedHeaderIn.Load() != 0 {
+		return errors.New("spdy: header blocks were already exchanged")
+	}
+	f.headerCompressionDisabled = true
+	return nil
+}
+
+// HeaderStats returns the number of header block bytes sent and received so far.
+// It can be called while the Framer is in use.
+func (f *Framer) HeaderStats() HeaderStats {
+	return HeaderStats{
+		RawOut:        f.rawHeaderOut.Load(),
+		CompressedOut: f.compressedHeaderOut.Load(),
+		RawIn:         f.rawHeaderIn.Load(),
+		CompressedIn:  f.compressedHeaderIn.Load(),
+	}
+}
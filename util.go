@@ -25,6 +25,8 @@ func (frame *NoopFrame)		GetStreamId() (uint32, bool)	{ return 0, false }
 func (frame *SettingsFrame)	GetStreamId() (uint32, bool)	{ return 0, false }
 func (frame *PingFrame)		GetStreamId() (uint32, bool)	{ return 0, false }
 func (frame *GoAwayFrame)	GetStreamId() (uint32, bool)	{ return 0, false }
+func (frame *WindowUpdateFrame)	GetStreamId() (uint32, bool)	{ return frame.StreamId, frame.StreamId != 0 }
+func (frame *UnknownFrame)	GetStreamId() (uint32, bool)	{ return 0, false }
 
 func (frame *DataFrame)		GetHeaders() *http.Header	{ return nil }
 func (frame *SynStreamFrame)	GetHeaders() *http.Header	{ return &frame.Headers}
@@ -35,6 +37,8 @@ func (frame *NoopFrame)		GetHeaders() *http.Header	{ return nil }
 func (frame *SettingsFrame)	GetHeaders() *http.Header	{ return nil }
 func (frame *PingFrame)		GetHeaders() *http.Header	{ return nil }
 func (frame *GoAwayFrame)	GetHeaders() *http.Header	{ return nil }
+func (frame *WindowUpdateFrame)	GetHeaders() *http.Header	{ return nil }
+func (frame *UnknownFrame)	GetHeaders() *http.Header	{ return nil }
 
 func (frame *DataFrame)		GetFinFlag() bool	{ return frame.Flags&DataFlagFin != 0 }
 func (frame *SynStreamFrame)	GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
@@ -45,6 +49,8 @@ func (frame *NoopFrame)		GetFinFlag() bool	{ return frame.CFHeader.Flags&Control
 func (frame *SettingsFrame)	GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
 func (frame *PingFrame)		GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
 func (frame *GoAwayFrame)	GetFinFlag() bool	{ return frame.CFHeader.Flags&ControlFlagFin != 0 }
+func (frame *WindowUpdateFrame)	GetFinFlag() bool	{ return false }
+func (frame *UnknownFrame)	GetFinFlag() bool	{ return false }
 
 
 
@@ -106,7 +112,6 @@ func Copy(w Writer, r Reader) error {
 			return err
 		}
 	}
-	return nil
 }
 
 // CopyBytes reads frames from src, extracts payload data
@@ -131,7 +136,6 @@ func CopyBytes(dst io.Writer, src Reader) error {
 			}
 		}
 	}
-	return nil
 }
 
 // Splice runs Copy(a, b) and Copy(b, a) in 2 distinct goroutines then waits for
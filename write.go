@@ -23,7 +23,7 @@ func (frame *RstStreamFrame) write(f *Framer) (err error) {
 	if frame.StreamId == 0 {
 		return &Error{ZeroStreamId, 0}
 	}
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.version
 	frame.CFHeader.frameType = TypeRstStream
 	frame.CFHeader.length = 8
 
@@ -41,7 +41,7 @@ func (frame *RstStreamFrame) write(f *Framer) (err error) {
 }
 
 func (frame *SettingsFrame) write(f *Framer) (err error) {
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.version
 	frame.CFHeader.frameType = TypeSettings
 	frame.CFHeader.length = uint32(len(frame.FlagIdValues)*8 + 4)
 
@@ -65,7 +65,7 @@ func (frame *SettingsFrame) write(f *Framer) (err error) {
 }
 
 func (frame *NoopFrame) write(f *Framer) error {
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.version
 	frame.CFHeader.frameType = TypeNoop
 
 	// Serialize frame to Writer
@@ -76,7 +76,7 @@ func (frame *PingFrame) write(f *Framer) (err error) {
 	if frame.Id == 0 {
 		return &Error{ZeroStreamId, 0}
 	}
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.version
 	frame.CFHeader.frameType = TypePing
 	frame.CFHeader.length = 4
 
@@ -91,9 +91,12 @@ func (frame *PingFrame) write(f *Framer) (err error) {
 }
 
 func (frame *GoAwayFrame) write(f *Framer) (err error) {
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.version
 	frame.CFHeader.frameType = TypeGoAway
 	frame.CFHeader.length = 4
+	if f.version >= Version3 {
+		frame.CFHeader.length = 8
+	}
 
 	// Serialize frame to Writer
 	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
@@ -102,6 +105,11 @@ func (frame *GoAwayFrame) write(f *Framer) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.LastGoodStreamId); err != nil {
 		return
 	}
+	if f.version >= Version3 {
+		if err = binary.Write(f.w, binary.BigEndian, frame.Status); err != nil {
+			return
+		}
+	}
 	return nil
 }
 
@@ -112,6 +120,34 @@ func (frame *HeadersFrame) write(f *Framer) error {
 	return f.writeHeadersFrame(frame)
 }
 
+func (frame *WindowUpdateFrame) write(f *Framer) (err error) {
+	frame.CFHeader.version = f.version
+	frame.CFHeader.frameType = TypeWindowUpdate
+	frame.CFHeader.length = 8
+
+	// Serialize frame to Writer
+	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
+		return
+	}
+	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
+		return
+	}
+	if err = binary.Write(f.w, binary.BigEndian, frame.DeltaWindowSize); err != nil {
+		return
+	}
+	return
+}
+
+// An UnknownFrame is written back as it was read, with its own type and version.
+func (frame *UnknownFrame) write(f *Framer) error {
+	frame.CFHeader.length = uint32(len(frame.Payload))
+	if err := writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
+		return err
+	}
+	_, err := f.w.Write(frame.Payload)
+	return err
+}
+
 func (frame *DataFrame) write(f *Framer) error {
 	if frame.StreamId == 0 {
 		return &Error{ZeroStreamId, 0}
@@ -138,27 +174,36 @@ func writeControlFrameHeader(w io.Writer, h ControlFrameHeader) error {
 	return nil
 }
 
-func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
-	n = 0
-	if err = binary.Write(w, binary.BigEndian, uint16(len(h))); err != nil {
+// writeHeaderLength writes a count or a length to a name/value header block.
+// Those are 16-bit wide in version 2, and 32-bit wide in version 3.
+func writeHeaderLength(w io.Writer, version uint16, length int) (n int, err error) {
+	if version >= Version3 {
+		return 4, binary.Write(w, binary.BigEndian, uint32(length))
+	}
+	return 2, binary.Write(w, binary.BigEndian, uint16(length))
+}
+
+func writeHeaderValueBlock(w io.Writer, version uint16, h http.Header) (n int, err error) {
+	var m int
+	if m, err = writeHeaderLength(w, version, len(h)); err != nil {
 		return
 	}
-	n += 2
+	n += m
 	for name, values := range h {
-		if err = binary.Write(w, binary.BigEndian, uint16(len(name))); err != nil {
+		if m, err = writeHeaderLength(w, version, len(name)); err != nil {
 			return
 		}
-		n += 2
+		n += m
 		name = strings.ToLower(name)
 		if _, err = io.WriteString(w, name); err != nil {
 			return
 		}
 		n += len(name)
 		v := strings.Join(values, "\x00")
-		if err = binary.Write(w, binary.BigEndian, uint16(len(v))); err != nil {
+		if m, err = writeHeaderLength(w, version, len(v)); err != nil {
 			return
 		}
-		n += 2
+		n += m
 		if _, err = io.WriteString(w, v); err != nil {
 			return
 		}
@@ -167,24 +212,37 @@ func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
 	return
 }
 
-func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
-	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
-	}
-	// Marshal the headers.
+// marshalHeaderBlock writes a compressed header block to f.headerBuf.
+func (f *Framer) marshalHeaderBlock(headers http.Header) error {
 	var writer io.Writer = f.headerBuf
 	if !f.headerCompressionDisabled {
 		writer = f.headerCompressor
 	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
-		return
+	n, err := writeHeaderValueBlock(writer, f.version, headers)
+	if err != nil {
+		return err
 	}
 	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
+		if err := f.headerCompressor.Flush(); err != nil {
+			return err
+		}
+	}
+	f.rawHeaderOut.Add(int64(n))
+	f.compressedHeaderOut.Add(int64(f.headerBuf.Len()))
+	return nil
+}
+
+func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
+	if frame.StreamId == 0 {
+		return &Error{ZeroStreamId, 0}
+	}
+	// Marshal the headers.
+	if err = f.marshalHeaderBlock(frame.Headers); err != nil {
+		return
 	}
 
 	// Set ControlFrameHeader
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.version
 	frame.CFHeader.frameType = TypeSynStream
 	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 10)
 
@@ -198,7 +256,11 @@ func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.AssociatedToStreamId); err != nil {
 		return err
 	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.Priority<<14); err != nil {
+	priority := frame.Priority << 14
+	if f.version >= Version3 {
+		priority = frame.Priority<<13 | uint16(frame.Slot)
+	}
+	if err = binary.Write(f.w, binary.BigEndian, priority); err != nil {
 		return err
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
@@ -213,21 +275,17 @@ func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 		return &Error{ZeroStreamId, 0}
 	}
 	// Marshal the headers.
-	var writer io.Writer = f.headerBuf
-	if !f.headerCompressionDisabled {
-		writer = f.headerCompressor
-	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	if err = f.marshalHeaderBlock(frame.Headers); err != nil {
 		return
 	}
-	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
-	}
 
 	// Set ControlFrameHeader
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.version
 	frame.CFHeader.frameType = TypeSynReply
-	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 6)
+	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 4)
+	if f.version < Version3 {
+		frame.CFHeader.length += 2
+	}
 
 	// Serialize frame to Writer
 	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
@@ -236,8 +294,10 @@ func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
 		return
 	}
-	if err = binary.Write(f.w, binary.BigEndian, uint16(0)); err != nil {
-		return
+	if f.version < Version3 {
+		if err = binary.Write(f.w, binary.BigEndian, uint16(0)); err != nil {
+			return
+		}
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
 		return
@@ -248,21 +308,17 @@ func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 
 func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 	// Marshal the headers.
-	var writer io.Writer = f.headerBuf
-	if !f.headerCompressionDisabled {
-		writer = f.headerCompressor
-	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	if err = f.marshalHeaderBlock(frame.Headers); err != nil {
 		return
 	}
-	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
-	}
 
 	// Set ControlFrameHeader
-	frame.CFHeader.version = Version
+	frame.CFHeader.version = f.version
 	frame.CFHeader.frameType = TypeHeaders
-	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 6)
+	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 4)
+	if f.version < Version3 {
+		frame.CFHeader.length += 2
+	}
 
 	// Serialize frame to Writer
 	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
@@ -271,8 +327,10 @@ func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
 		return
 	}
-	if err = binary.Write(f.w, binary.BigEndian, uint16(0)); err != nil {
-		return
+	if f.version < Version3 {
+		if err = binary.Write(f.w, binary.BigEndian, uint16(0)); err != nil {
+			return
+		}
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
 		return